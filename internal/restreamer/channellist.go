@@ -0,0 +1,282 @@
+package restreamer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/request"
+)
+
+const channelListTimeout = time.Minute
+
+var (
+	m3uAttributeRegex = regexp.MustCompile(`([\w-]+)="([^"]*)"`)
+	streamIDRegex     = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// channelLists holds the streams imported from the extended M3U channel lists listed
+// in the channel-lists section of the config. All the lists are fetched with the same
+// request, reusing its connections.
+type channelLists struct {
+	mutex       sync.RWMutex
+	sources     map[string][]streamConfig
+	requestOnce sync.Once
+	request     request.Request
+	requestErr  error
+}
+
+var importedStreams = &channelLists{
+	sources: make(map[string][]streamConfig),
+}
+
+// initRequest creates the request fetching the lists once the config is read, using the
+// global proxy and TLS settings.
+func (c *channelLists) initRequest() error {
+	c.requestOnce.Do(func() {
+		client, err := request.NewClientWithConfig(transportConfig(streamConfig{}))
+		if err != nil {
+			c.requestErr = fmt.Errorf("invalid transport config for channel lists: %w", err)
+			return
+		}
+		c.request = request.New("restreamer", request.WithClient(client))
+	})
+
+	return c.requestErr
+}
+
+func (c *channelLists) get(streamID string) (streamConfig, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for _, streams := range c.sources {
+		for _, stream := range streams {
+			if stream.ID == streamID {
+				return stream, true
+			}
+		}
+	}
+
+	return streamConfig{}, false
+}
+
+func (c *channelLists) all() []streamConfig {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	streams := make([]streamConfig, 0)
+	for _, sourceStreams := range c.sources {
+		streams = append(streams, sourceStreams...)
+	}
+
+	return streams
+}
+
+// load fetches all the channel lists. If a list cannot be fetched the streams loaded
+// from the previous successful fetch are kept.
+func (c *channelLists) load(ctx context.Context) {
+	sources := viper.GetStringSlice("channel-lists.sources")
+	if err := c.initRequest(); err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	loaded := make(map[string][]streamConfig)
+	usedIDs := make(map[string]bool)
+
+	for _, source := range sources {
+		streams, err := fetchChannelList(ctx, c.request, source)
+		if err != nil {
+			log.Printf("Error loading channel list %s: %v", source, err)
+
+			c.mutex.RLock()
+			streams = c.sources[source]
+			c.mutex.RUnlock()
+		}
+
+		loaded[source] = uniqueStreamIDs(streams, usedIDs)
+		log.Printf("Loaded %d streams from channel list %s", len(loaded[source]), source)
+	}
+
+	c.mutex.Lock()
+	c.sources = loaded
+	c.mutex.Unlock()
+}
+
+// watch loads the channel lists and reloads them periodically until the context is cancelled.
+func (c *channelLists) watch(ctx context.Context) {
+	c.load(ctx)
+
+	refresh := viper.GetDuration("channel-lists.refresh")
+	if refresh <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.load(ctx)
+		}
+	}
+}
+
+func fetchChannelList(ctx context.Context, channelListRequest request.Request, source string) ([]streamConfig, error) {
+	sourceURL, err := url.Parse(source)
+	if err != nil || (sourceURL.Scheme != "http" && sourceURL.Scheme != "https") {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open file: %w", err)
+		}
+		defer file.Close()
+
+		return parseChannelList(file)
+	}
+
+	requestCtx, cancel := context.WithTimeout(ctx, channelListTimeout)
+	defer cancel()
+
+	response, err := channelListRequest.Do(requestCtx, source)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer response.Body.Close()
+
+	return parseChannelList(response.Body)
+}
+
+// parseChannelList parses an extended M3U channel list. Stream ids are derived from
+// the tvg-id attribute or the channel name if tvg-id is missing.
+func parseChannelList(reader io.Reader) ([]streamConfig, error) {
+	streams := make([]streamConfig, 0)
+	scanner := bufio.NewScanner(reader)
+
+	var current *streamConfig
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#EXTINF:"):
+			stream := parseExtInf(line)
+			current = &stream
+		case strings.HasPrefix(line, "#EXTGRP:"):
+			if current != nil && current.Group == "" {
+				current.Group = strings.TrimSpace(line[len("#EXTGRP:"):])
+			}
+		case strings.HasPrefix(line, "#"):
+			continue
+		default:
+			if current == nil {
+				current = &streamConfig{}
+			}
+			current.URL = line
+			if current.Name == "" {
+				current.Name = line
+			}
+			if current.ID == "" {
+				current.ID = current.Name
+			}
+			current.ID = streamID(current.ID)
+
+			streams = append(streams, *current)
+			current = nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read channel list: %w", err)
+	}
+
+	return streams, nil
+}
+
+// streamID returns the stream id of a tvg-id or channel name. Names without any latin letter
+// or digit, like Cyrillic or CJK names, get an id derived from a hash of the name.
+func streamID(name string) string {
+	id := strings.Trim(streamIDRegex.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if id != "" {
+		return id
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+
+	return fmt.Sprintf("channel-%08x", hash.Sum32())
+}
+
+func parseExtInf(line string) streamConfig {
+	stream := streamConfig{}
+
+	// The channel name follows the first comma that is not within a quoted attribute value.
+	inQuotes := false
+	attributes := line
+	for i, char := range line {
+		if char == '"' {
+			inQuotes = !inQuotes
+		}
+		if char == ',' && !inQuotes {
+			attributes = line[:i]
+			stream.Name = strings.TrimSpace(line[i+1:])
+			break
+		}
+	}
+
+	for _, match := range m3uAttributeRegex.FindAllStringSubmatch(attributes, -1) {
+		switch strings.ToLower(match[1]) {
+		case "tvg-id":
+			stream.ID = match[2]
+		case "tvg-name":
+			if stream.Name == "" {
+				stream.Name = match[2]
+			}
+		case "tvg-logo":
+			stream.Logo = match[2]
+		case "group-title":
+			stream.Group = match[2]
+		case "tvg-chno":
+			stream.Channel = match[2]
+		}
+	}
+
+	return stream
+}
+
+// uniqueStreamIDs adds a numeric suffix to stream ids already used by another entry of
+// the channel lists. Streams with the same id as one in the streams section of the config
+// are dropped as the hand-written entry takes precedence.
+func uniqueStreamIDs(streams []streamConfig, usedIDs map[string]bool) []streamConfig {
+	unique := make([]streamConfig, 0, len(streams))
+	for _, stream := range streams {
+		if stream.ID == "" || viper.IsSet("streams."+stream.ID) {
+			continue
+		}
+
+		id := stream.ID
+		for i := 2; usedIDs[id]; i++ {
+			id = fmt.Sprintf("%s-%d", stream.ID, i)
+		}
+		usedIDs[id] = true
+		stream.ID = id
+
+		unique = append(unique, stream)
+	}
+
+	return unique
+}
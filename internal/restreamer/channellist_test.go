@@ -0,0 +1,124 @@
+package restreamer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseChannelList(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		want []streamConfig
+	}{
+		{
+			name: "attributes",
+			list: `#EXTM3U
+#EXTINF:-1 tvg-id="News.uk" tvg-name="News" tvg-logo="http://example.com/news.png" group-title="Info, UK" tvg-chno="101",News HD
+http://example.com/news.m3u8`,
+			want: []streamConfig{{
+				ID: "news-uk", URL: "http://example.com/news.m3u8", Name: "News HD",
+				Logo: "http://example.com/news.png", Group: "Info, UK", Channel: "101",
+			}},
+		},
+		{
+			name: "tvg-name and EXTGRP",
+			list: `#EXTINF:-1 TVG-ID="sports" tvg-name="Sports",
+#EXTGRP:Sport
+http://example.com/sports.m3u8`,
+			want: []streamConfig{{ID: "sports", URL: "http://example.com/sports.m3u8", Name: "Sports", Group: "Sport"}},
+		},
+		{
+			name: "missing tvg-id",
+			list: `#EXTINF:-1 group-title="Movies",Movies & Series!
+http://example.com/movies.m3u8`,
+			want: []streamConfig{{ID: "movies-series", URL: "http://example.com/movies.m3u8", Name: "Movies & Series!", Group: "Movies"}},
+		},
+		{
+			name: "non-latin names",
+			list: `#EXTINF:-1,Первый канал
+http://example.com/1.m3u8
+#EXTINF:-1,الجزيرة
+http://example.com/2.m3u8
+#EXTINF:-1 tvg-id="中央电视台",CCTV
+http://example.com/3.m3u8`,
+			want: []streamConfig{
+				{ID: "channel-25cbba8d", URL: "http://example.com/1.m3u8", Name: "Первый канал"},
+				{ID: "channel-e65501cc", URL: "http://example.com/2.m3u8", Name: "الجزيرة"},
+				{ID: "channel-ab84d31a", URL: "http://example.com/3.m3u8", Name: "CCTV"},
+			},
+		},
+		{
+			name: "malformed EXTINF",
+			list: `#EXTINF:-1 tvg-id="broken
+http://example.com/broken.m3u8
+#EXTINF:
+http://example.com/empty.m3u8
+http://example.com/bare.m3u8`,
+			want: []streamConfig{
+				{ID: "http-example-com-broken-m3u8", URL: "http://example.com/broken.m3u8", Name: "http://example.com/broken.m3u8"},
+				{ID: "http-example-com-empty-m3u8", URL: "http://example.com/empty.m3u8", Name: "http://example.com/empty.m3u8"},
+				{ID: "http-example-com-bare-m3u8", URL: "http://example.com/bare.m3u8", Name: "http://example.com/bare.m3u8"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			streams, err := parseChannelList(strings.NewReader(test.list))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(streams, test.want) {
+				t.Fatalf("got %+v, want %+v", streams, test.want)
+			}
+		})
+	}
+}
+
+func TestUniqueStreamIDs(t *testing.T) {
+	setStreams(t, map[string]interface{}{"configured": "http://example.com/configured.m3u8"})
+
+	usedIDs := make(map[string]bool)
+	first := uniqueStreamIDs([]streamConfig{{ID: "news"}, {ID: "news"}, {ID: "configured"}}, usedIDs)
+	second := uniqueStreamIDs([]streamConfig{{ID: "news"}, {ID: "news-2"}}, usedIDs)
+
+	var ids []string
+	for _, stream := range append(first, second...) {
+		ids = append(ids, stream.ID)
+	}
+	if want := []string{"news", "news-2", "news-3", "news-2-2"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got ids %v, want %v", ids, want)
+	}
+}
+
+func TestChannelListsProxy(t *testing.T) {
+	var proxiedURL string
+	proxy := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		proxiedURL = request.URL.String()
+		io.WriteString(writer, "#EXTM3U\n#EXTINF:-1 tvg-id=\"news\",News\nhttp://example.com/news.m3u8\n")
+	}))
+	defer proxy.Close()
+
+	viper.Set("proxy", proxy.URL)
+	viper.Set("channel-lists.sources", []string{"http://lists.invalid/channels.m3u"})
+	defer viper.Set("proxy", nil)
+	defer viper.Set("channel-lists.sources", nil)
+
+	lists := &channelLists{sources: make(map[string][]streamConfig)}
+	lists.load(context.Background())
+
+	if proxiedURL != "http://lists.invalid/channels.m3u" {
+		t.Fatalf("proxy received %q", proxiedURL)
+	}
+	if stream, ok := lists.get("news"); !ok || stream.URL != "http://example.com/news.m3u8" {
+		t.Fatalf("got stream %+v", stream)
+	}
+}
@@ -41,9 +41,15 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file")
 	rootCmd.PersistentFlags().Float64P("max-bandwidth", "m", 10, "max bandwidth in mb/sec")
 	rootCmd.PersistentFlags().Float64P("read-buffer", "b", 1, "read buffer in MB")
+	rootCmd.PersistentFlags().IntP("concurrency", "n", 1, "number of segments downloaded concurrently")
+	rootCmd.PersistentFlags().String("proxy", "", "http, https or socks5 proxy url")
+	rootCmd.PersistentFlags().Bool("insecure", false, "skip verification of TLS certificates")
 
 	bindFlagToConfig(rootCmd, "max-bandwidth", "max-bandwidth")
 	bindFlagToConfig(rootCmd, "read-buffer", "read-buffer")
+	bindFlagToConfig(rootCmd, "concurrency", "concurrency")
+	bindFlagToConfig(rootCmd, "proxy", "proxy")
+	bindFlagToConfig(rootCmd, "insecure", "tls.insecure-skip-verify")
 }
 
 func bindFlagToConfig(cmd *cobra.Command, flag, configPath string) {
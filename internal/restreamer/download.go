@@ -18,22 +18,40 @@ var downloadCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		streamID, _ := cmd.Flags().GetString("stream-id")
 		fileName, _ := cmd.Flags().GetString("filename")
+		file := &mediaFile{name: fileName}
 		if fileName == "" {
-			fileName = filepath.Join(viper.GetString("download.path"), fmt.Sprintf("%s_%d.ts", streamID, time.Now().Unix()))
+			file.prefix = filepath.Join(viper.GetString("download.path"), fmt.Sprintf("%s_%d", streamID, time.Now().Unix()))
 		}
 
-		file, err := os.Create(fileName)
-		if err != nil {
-			log.Printf("Error: cannot open file %s", fileName)
-			return
+		importedStreams.load(context.Background())
+
+		options := startOptions{}
+		options.maxLiveDuration, _ = cmd.Flags().GetDuration("duration")
+
+		audioFileName, _ := cmd.Flags().GetString("audio-file")
+		if audioFileName != "" {
+			audioFile, err := os.Create(audioFileName)
+			if err != nil {
+				log.Printf("Error: cannot open file %s", audioFileName)
+				return
+			}
+			defer audioFile.Close()
+			options.audioWriter = audioFile
 		}
 
-		duration, _ := cmd.Flags().GetDuration("duration")
-		segmentsContext, cancel := context.WithTimeout(context.Background(), duration)
-		defer cancel()
+		subtitlesFileName, _ := cmd.Flags().GetString("subtitles-file")
+		if subtitlesFileName != "" {
+			subtitlesFile, err := os.Create(subtitlesFileName)
+			if err != nil {
+				log.Printf("Error: cannot open file %s", subtitlesFileName)
+				return
+			}
+			defer subtitlesFile.Close()
+			options.subtitleWriter = subtitlesFile
+		}
 
-		log.Printf("Starting to download stream with id %s for %v", streamID, duration)
-		if err := start(segmentsContext, file, streamID); err != nil {
+		log.Printf("Starting to download stream with id %s, stopping live streams after %v", streamID, options.maxLiveDuration)
+		if err := start(context.Background(), file, streamID, options); err != nil {
 			log.Printf("Error: %v", err)
 		}
 		log.Printf("Download stream with id %s stopped", streamID)
@@ -42,11 +60,50 @@ var downloadCmd = &cobra.Command{
 	},
 }
 
+// mediaFile creates the file of a download on the first write. Unless a name is given the
+// file is named with the extension of the container of the stream.
+type mediaFile struct {
+	name   string
+	prefix string
+	file   *os.File
+}
+
+func (m *mediaFile) Write(p []byte) (int, error) {
+	if m.file == nil {
+		name := m.name
+		if name == "" {
+			name = m.prefix + ".ts"
+			if isMP4(p) {
+				name = m.prefix + ".mp4"
+			}
+		}
+
+		file, err := os.Create(name)
+		if err != nil {
+			return 0, fmt.Errorf("cannot open file %s: %w", name, err)
+		}
+		log.Printf("Saving stream to %s", name)
+		m.file = file
+	}
+
+	return m.file.Write(p)
+}
+
+func (m *mediaFile) Close() error {
+	if m.file == nil {
+		return nil
+	}
+
+	return m.file.Close()
+}
+
 func init() {
 	downloadCmd.Flags().StringP("download-path", "d", ".", "path to store downloaded media")
 	downloadCmd.Flags().StringP("filename", "f", "", "filename of downloaded media")
 	downloadCmd.Flags().StringP("stream-id", "s", "", "stream id")
-	downloadCmd.Flags().DurationP("duration", "t", time.Hour*12, "stream duration")
+	downloadCmd.Flags().String("audio-file", "", "filename to save the alternate audio rendition to")
+	downloadCmd.Flags().String("subtitles-file", "", "filename to save the subtitles rendition to")
+	downloadCmd.Flags().DurationP("duration", "t", time.Hour*12, "maximum duration of live streams, VOD streams are downloaded to the end")
 
 	bindFlagToConfig(downloadCmd, "download-path", "download.path")
 	if err := downloadCmd.MarkFlagRequired("stream-id"); err != nil {
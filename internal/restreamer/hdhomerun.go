@@ -0,0 +1,190 @@
+package restreamer
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+type hdhrDiscover struct {
+	FriendlyName    string
+	Manufacturer    string
+	ModelNumber     string
+	FirmwareName    string
+	FirmwareVersion string
+	DeviceID        string
+	DeviceAuth      string
+	BaseURL         string
+	LineupURL       string
+	TunerCount      int
+}
+
+type hdhrLineupItem struct {
+	GuideNumber string
+	GuideName   string
+	URL         string
+}
+
+type hdhrLineupStatus struct {
+	ScanInProgress int
+	ScanPossible   int
+	Source         string
+	SourceList     []string
+}
+
+type hdhrDevice struct {
+	XMLName     xml.Name `xml:"urn:schemas-upnp-org:device-1-0 root"`
+	URLBase     string   `xml:"URLBase"`
+	SpecVersion struct {
+		Major int `xml:"major"`
+		Minor int `xml:"minor"`
+	} `xml:"specVersion"`
+	Device struct {
+		DeviceType   string `xml:"deviceType"`
+		FriendlyName string `xml:"friendlyName"`
+		Manufacturer string `xml:"manufacturer"`
+		ModelName    string `xml:"modelName"`
+		ModelNumber  string `xml:"modelNumber"`
+		SerialNumber string `xml:"serialNumber"`
+		UDN          string `xml:"UDN"`
+	} `xml:"device"`
+}
+
+func init() {
+	viper.SetDefault("hdhomerun.device-id", "52455354")
+	viper.SetDefault("hdhomerun.friendly-name", "restreamer")
+	viper.SetDefault("hdhomerun.tuner-count", 4)
+}
+
+func registerHDHomeRun(mux *http.ServeMux) {
+	mux.HandleFunc("/discover.json", hdhrDiscoverHandler)
+	mux.HandleFunc("/lineup.json", hdhrLineupHandler)
+	mux.HandleFunc("/lineup_status.json", hdhrLineupStatusHandler)
+	mux.HandleFunc("/lineup.post", hdhrLineupPostHandler)
+	mux.HandleFunc("/device.xml", hdhrDeviceHandler)
+}
+
+// baseURL returns the URL the server was requested with, using the scheme set by a
+// reverse proxy in X-Forwarded-Proto if any.
+func baseURL(request *http.Request) string {
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := request.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, request.Host)
+}
+
+func hdhrDiscoverHandler(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, hdhrDiscover{
+		FriendlyName:    viper.GetString("hdhomerun.friendly-name"),
+		Manufacturer:    "Silicondust",
+		ModelNumber:     "HDTC-2US",
+		FirmwareName:    "hdhomeruntc_atsc",
+		FirmwareVersion: "20200101",
+		DeviceID:        viper.GetString("hdhomerun.device-id"),
+		DeviceAuth:      "restreamer",
+		BaseURL:         baseURL(request),
+		LineupURL:       baseURL(request) + "/lineup.json",
+		TunerCount:      viper.GetInt("hdhomerun.tuner-count"),
+	})
+}
+
+func hdhrLineupHandler(writer http.ResponseWriter, request *http.Request) {
+	lineup := make([]hdhrLineupItem, 0)
+	streams := getStreams()
+	numbers := guideNumbers(streams)
+	for _, stream := range streams {
+		lineup = append(lineup, hdhrLineupItem{
+			GuideNumber: numbers[stream.ID],
+			GuideName:   stream.Name,
+			URL:         fmt.Sprintf("%s/%s", baseURL(request), stream.ID),
+		})
+	}
+
+	writeJSON(writer, lineup)
+}
+
+// guideNumbers returns the channel number of each stream keyed by stream id. Streams
+// without a configured channel get a number derived from their id, so that adding or
+// removing a stream does not renumber the others.
+func guideNumbers(streams []streamConfig) map[string]string {
+	numbers := make(map[string]string)
+	used := make(map[string]bool)
+	for _, stream := range streams {
+		if stream.Channel != "" {
+			numbers[stream.ID] = stream.Channel
+			used[stream.Channel] = true
+		}
+	}
+
+	for _, stream := range streams {
+		if stream.Channel != "" {
+			continue
+		}
+
+		hash := fnv.New32a()
+		hash.Write([]byte(stream.ID))
+		number := int(hash.Sum32()%9000) + 1000
+		for used[strconv.Itoa(number)] {
+			number = (number-999)%9000 + 1000
+		}
+		numbers[stream.ID] = strconv.Itoa(number)
+		used[numbers[stream.ID]] = true
+	}
+
+	return numbers
+}
+
+func hdhrLineupStatusHandler(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, hdhrLineupStatus{
+		ScanInProgress: 0,
+		ScanPossible:   1,
+		Source:         "Cable",
+		SourceList:     []string{"Cable"},
+	})
+}
+
+// Channel scans are requested by some media servers but the lineup is always derived
+// from the config so there is nothing to scan.
+func hdhrLineupPostHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.WriteHeader(http.StatusOK)
+}
+
+func hdhrDeviceHandler(writer http.ResponseWriter, request *http.Request) {
+	device := hdhrDevice{URLBase: baseURL(request)}
+	device.SpecVersion.Major = 1
+	device.Device.DeviceType = "urn:schemas-upnp-org:device:MediaServer:1"
+	device.Device.FriendlyName = viper.GetString("hdhomerun.friendly-name")
+	device.Device.Manufacturer = "Silicondust"
+	device.Device.ModelName = "HDTC-2US"
+	device.Device.ModelNumber = "HDTC-2US"
+	device.Device.SerialNumber = viper.GetString("hdhomerun.device-id")
+	device.Device.UDN = "uuid:" + viper.GetString("hdhomerun.device-id")
+
+	writer.Header().Set("Content-Type", "application/xml")
+	if _, err := writer.Write([]byte(xml.Header)); err != nil {
+		log.Printf("Error writing device.xml: %v", err)
+		return
+	}
+	if err := xml.NewEncoder(writer).Encode(device); err != nil {
+		log.Printf("Error writing device.xml: %v", err)
+	}
+}
+
+func writeJSON(writer http.ResponseWriter, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package restreamer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestGuideNumbersStable(t *testing.T) {
+	streams := []streamConfig{{ID: "news"}, {ID: "sports"}, {ID: "movies", Channel: "7"}}
+	numbers := guideNumbers(streams)
+
+	if numbers["movies"] != "7" {
+		t.Fatalf("configured channel replaced by %s", numbers["movies"])
+	}
+
+	// Adding and removing streams does not renumber the others.
+	changed := guideNumbers([]streamConfig{{ID: "kids"}, {ID: "sports"}, {ID: "weather", Channel: "9"}})
+	if changed["sports"] != numbers["sports"] {
+		t.Fatalf("sports renumbered from %s to %s", numbers["sports"], changed["sports"])
+	}
+	if again := guideNumbers(streams); again["news"] != numbers["news"] {
+		t.Fatalf("news renumbered from %s to %s", numbers["news"], again["news"])
+	}
+}
+
+func TestGuideNumbersUnique(t *testing.T) {
+	// A configured channel takes precedence over the number derived for another stream.
+	derived := guideNumbers([]streamConfig{{ID: "news"}})["news"]
+	numbers := guideNumbers([]streamConfig{{ID: "news"}, {ID: "other", Channel: derived}})
+	if numbers["other"] != derived || numbers["news"] == derived {
+		t.Fatalf("got numbers %v", numbers)
+	}
+
+	streams := make([]streamConfig, 0, 3000)
+	for i := 0; i < 3000; i++ {
+		streams = append(streams, streamConfig{ID: fmt.Sprintf("stream-%d", i)})
+	}
+
+	used := make(map[string]string)
+	for streamID, number := range guideNumbers(streams) {
+		if other, ok := used[number]; ok {
+			t.Fatalf("%s and %s have the same number %s", streamID, other, number)
+		}
+		used[number] = streamID
+
+		if value, err := strconv.Atoi(number); err != nil || value < 1000 || value > 9999 {
+			t.Fatalf("%s has number %s", streamID, number)
+		}
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		forwarded string
+		tls       bool
+		want      string
+	}{
+		{name: "http", want: "http://tuner:8080"},
+		{name: "tls", tls: true, want: "https://tuner:8080"},
+		{name: "reverse proxy", forwarded: "https, http", want: "https://tuner:8080"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "http://tuner:8080/discover.json", nil)
+			if test.tls {
+				request.TLS = &tls.ConnectionState{}
+			}
+			if test.forwarded != "" {
+				request.Header.Set("X-Forwarded-Proto", test.forwarded)
+			}
+
+			if got := baseURL(request); got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
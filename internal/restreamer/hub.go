@@ -0,0 +1,225 @@
+package restreamer
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/shaunschembri/restreamer/pkg/restream"
+	"github.com/shaunschembri/restreamer/pkg/restream/ts"
+)
+
+// Number of chunks buffered for each viewer before it is considered too slow and dropped.
+const viewerBuffer = 256
+
+type viewer struct {
+	data chan []byte
+	once sync.Once
+	// synced is set once the viewer receives the stream, which viewers joining a running
+	// stream start at a sync point, preceded by the initialization section of fMP4 streams.
+	synced bool
+}
+
+func (v *viewer) close() {
+	v.once.Do(func() { close(v.data) })
+}
+
+// hub runs a single restream pipeline for a stream id and broadcasts its output to
+// all attached viewers.
+type hub struct {
+	streamID string
+	cancel   context.CancelFunc
+	mutex    sync.Mutex
+	viewers  map[*viewer]struct{}
+	streamer *restream.Restream
+	written  bool
+	boxes    *mp4Boxes
+}
+
+func (h *hub) Write(p []byte) (int, error) {
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.written && isMP4(chunk) {
+		h.boxes = &mp4Boxes{}
+	}
+	h.written = true
+
+	start, searched := 0, false
+	if h.boxes != nil {
+		start, searched = h.boxes.scan(chunk), true
+	}
+
+	for v := range h.viewers {
+		data := chunk
+		if !v.synced {
+			if !searched {
+				start, searched = syncPoint(chunk), true
+			}
+			if start < 0 {
+				continue
+			}
+			data = chunk[start:]
+			if h.boxes != nil {
+				data = append(append(append([]byte(nil), h.boxes.init...), h.boxes.carried...), data...)
+			}
+			v.synced = true
+		}
+
+		select {
+		case v.data <- data:
+		default:
+			log.Printf("Dropping slow viewer of stream with id %s", h.streamID)
+			delete(h.viewers, v)
+			v.close()
+		}
+	}
+
+	return len(p), nil
+}
+
+// syncPoint returns the offset of the first TS packet of p starting a PAT, from which a
+// player can start decoding the stream, or -1 if there is none.
+func syncPoint(p []byte) int {
+	for i := 0; i+4 <= len(p); i++ {
+		packet := p[i:]
+		if packet[0] != ts.SyncByte || ts.PID(packet) != ts.PATPID || !ts.PayloadUnitStart(packet) {
+			continue
+		}
+		if i+ts.PacketSize < len(p) && p[i+ts.PacketSize] != ts.SyncByte {
+			continue
+		}
+
+		return i
+	}
+
+	return -1
+}
+
+// attach adds a viewer, which starts at the next sync point if the stream is running.
+func (h *hub) attach() *viewer {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	v := &viewer{data: make(chan []byte, viewerBuffer), synced: !h.written}
+	h.viewers[v] = struct{}{}
+
+	return v
+}
+
+func (h *hub) setStreamer(streamer *restream.Restream) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.streamer = streamer
+}
+
+// stats returns the number of viewers of the hub and the stats of its restream, which are
+// empty until the restream is created.
+func (h *hub) stats() (int, restream.Stats) {
+	h.mutex.Lock()
+	viewers := len(h.viewers)
+	streamer := h.streamer
+	h.mutex.Unlock()
+
+	if streamer == nil {
+		return viewers, restream.Stats{}
+	}
+
+	return viewers, streamer.Stats()
+}
+
+func (h *hub) closeViewers() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for v := range h.viewers {
+		delete(h.viewers, v)
+		v.close()
+	}
+}
+
+type hubs struct {
+	mutex sync.Mutex
+	hubs  map[string]*hub
+}
+
+var streamHubs = &hubs{hubs: make(map[string]*hub)}
+
+// join attaches a new viewer to the hub of streamID, starting the restream pipeline
+// if this is the first viewer.
+func (h *hubs) join(streamID string) (*hub, *viewer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	streamHub, ok := h.hubs[streamID]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		streamHub = &hub{
+			streamID: streamID,
+			cancel:   cancel,
+			viewers:  make(map[*viewer]struct{}),
+		}
+		h.hubs[streamID] = streamHub
+
+		go h.run(ctx, streamHub)
+	}
+
+	return streamHub, streamHub.attach()
+}
+
+// leave detaches a viewer from its hub and stops the restream pipeline once the last
+// viewer is gone.
+func (h *hubs) leave(streamHub *hub, v *viewer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	streamHub.mutex.Lock()
+	delete(streamHub.viewers, v)
+	remaining := len(streamHub.viewers)
+	streamHub.mutex.Unlock()
+	v.close()
+
+	if remaining == 0 {
+		h.remove(streamHub)
+	}
+}
+
+func (h *hubs) run(ctx context.Context, streamHub *hub) {
+	log.Printf("Starting to restream stream with id %s", streamHub.streamID)
+	options := startOptions{started: streamHub.setStreamer}
+	if err := start(ctx, streamHub, streamHub.streamID, options); err != nil {
+		log.Println(err.Error())
+	}
+	log.Printf("Restream of stream with id %s stopped", streamHub.streamID)
+
+	h.mutex.Lock()
+	h.remove(streamHub)
+	h.mutex.Unlock()
+
+	streamHub.closeViewers()
+}
+
+// active returns the hubs currently restreaming.
+func (h *hubs) active() []*hub {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	active := make([]*hub, 0, len(h.hubs))
+	for _, streamHub := range h.hubs {
+		active = append(active, streamHub)
+	}
+
+	return active
+}
+
+// remove must be called with h.mutex held.
+func (h *hubs) remove(streamHub *hub) {
+	streamHub.cancel()
+	if h.hubs[streamHub.streamID] == streamHub {
+		delete(h.hubs, streamHub.streamID)
+	}
+}
@@ -0,0 +1,98 @@
+package restreamer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/ts"
+	"github.com/shaunschembri/restreamer/pkg/restream/ts/tstest"
+)
+
+func newTestHub() *hub {
+	return &hub{streamID: "test", viewers: make(map[*viewer]struct{})}
+}
+
+// received returns the chunks sent to v so far.
+func received(v *viewer) [][]byte {
+	chunks := make([][]byte, 0)
+	for {
+		select {
+		case chunk, ok := <-v.data:
+			if !ok {
+				return chunks
+			}
+			chunks = append(chunks, chunk)
+		default:
+			return chunks
+		}
+	}
+}
+
+func TestHubLateViewerSyncsAtPAT(t *testing.T) {
+	stream := tstest.NewStream()
+	videoSegment := func(timestamp uint64) []byte {
+		stream.Tables(tstest.PMT())
+		stream.PES(tstest.VideoPID, ts.NewPES(0xe0, timestamp, bytes.Repeat([]byte{0xaa}, 400)), nil)
+		return stream.Segment()
+	}
+
+	streamHub := newTestHub()
+	early := streamHub.attach()
+	first := videoSegment(90000)
+	streamHub.Write(first)
+
+	late := streamHub.attach()
+	if late.synced {
+		t.Fatal("viewer joining a running stream is synced")
+	}
+
+	// The chunk starts in the middle of a PES packet.
+	stream.PES(tstest.VideoPID, ts.NewPES(0xe0, 93000, bytes.Repeat([]byte{0xbb}, 400)), nil)
+	partial := stream.Segment()[ts.PacketSize:]
+	second := append(partial, videoSegment(96000)...)
+	streamHub.Write(second)
+	third := videoSegment(99000)
+	streamHub.Write(third)
+
+	if chunks := received(early); len(chunks) != 3 || !bytes.Equal(chunks[0], first) || !bytes.Equal(chunks[1], second) || !bytes.Equal(chunks[2], third) {
+		t.Fatalf("early viewer got %d chunks", len(chunks))
+	}
+
+	chunks := received(late)
+	if len(chunks) != 2 {
+		t.Fatalf("late viewer got %d chunks, want 2", len(chunks))
+	}
+	if !bytes.Equal(chunks[0], second[len(partial):]) {
+		t.Fatal("late viewer does not start at the PAT")
+	}
+	if !bytes.Equal(chunks[1], third) {
+		t.Fatal("late viewer did not get the chunk after the sync point")
+	}
+}
+
+func TestHubDropsSlowViewer(t *testing.T) {
+	streamHub := newTestHub()
+	slow := streamHub.attach()
+	fast := streamHub.attach()
+
+	chunk := make([]byte, ts.PacketSize)
+	for i := 0; i <= viewerBuffer; i++ {
+		streamHub.Write(chunk)
+		received(fast)
+	}
+
+	if _, ok := streamHub.viewers[slow]; ok {
+		t.Fatal("slow viewer was not dropped")
+	}
+	if _, ok := streamHub.viewers[fast]; !ok {
+		t.Fatal("viewer keeping up was dropped")
+	}
+
+	count := 0
+	for range slow.data {
+		count++
+	}
+	if count != viewerBuffer {
+		t.Fatalf("slow viewer got %d chunks before being closed, want %d", count, viewerBuffer)
+	}
+}
@@ -0,0 +1,239 @@
+package restreamer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/shaunschembri/restreamer/pkg/restream"
+	"github.com/shaunschembri/restreamer/pkg/restream/provider"
+	"github.com/shaunschembri/restreamer/pkg/restream/request"
+)
+
+// Upper bounds in seconds of the buckets of the segment download latency histogram.
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// streamCounters hold the counters of a stream, which are kept across restreams of the
+// stream so that they only increase.
+type streamCounters struct {
+	bytesIn          int64
+	bytesOut         int64
+	latencyBuckets   []int64
+	latencySum       float64
+	latencyCount     int64
+	playlistErrors   int64
+	retries          map[string]int64
+	decryptFailures  int64
+	variantBandwidth uint32
+	hasVariant       bool
+}
+
+type metrics struct {
+	mutex   sync.Mutex
+	streams map[string]*streamCounters
+}
+
+var streamMetrics = &metrics{streams: make(map[string]*streamCounters)}
+
+// counters returns the counters of streamID and must be called with m.mutex held.
+func (m *metrics) counters(streamID string) *streamCounters {
+	counters, ok := m.streams[streamID]
+	if !ok {
+		counters = &streamCounters{
+			latencyBuckets: make([]int64, len(latencyBuckets)),
+			retries:        make(map[string]int64),
+		}
+		m.streams[streamID] = counters
+	}
+
+	return counters
+}
+
+func (m *metrics) update(streamID string, update func(counters *streamCounters)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	update(m.counters(streamID))
+}
+
+func (m *metrics) addBytesOut(streamID string, bytes int) {
+	m.update(streamID, func(counters *streamCounters) {
+		counters.bytesOut += int64(bytes)
+	})
+}
+
+// observer returns the observer updating the metrics of a restream of streamID.
+func (m *metrics) observer(streamID string) restream.Observer {
+	return metricsObserver{metrics: m, streamID: streamID}
+}
+
+type metricsObserver struct {
+	restream.NopObserver
+	metrics  *metrics
+	streamID string
+}
+
+func (o metricsObserver) PlaylistRefreshed(event restream.PlaylistEvent) {
+	if event.Err == nil {
+		return
+	}
+
+	o.metrics.update(o.streamID, func(counters *streamCounters) {
+		counters.playlistErrors++
+	})
+}
+
+func (o metricsObserver) VariantSwitched(variant provider.Variant) {
+	o.metrics.update(o.streamID, func(counters *streamCounters) {
+		counters.variantBandwidth = variant.Bandwidth
+		counters.hasVariant = true
+	})
+}
+
+func (o metricsObserver) SegmentFinished(event restream.SegmentEvent) {
+	o.metrics.update(o.streamID, func(counters *streamCounters) {
+		counters.bytesIn += event.BytesDownloaded
+
+		if errors.Is(event.Err, restream.ErrDecryptionFailed) {
+			counters.decryptFailures++
+		}
+
+		// Gap segments are not downloaded.
+		if event.Segment.Gap || event.DownloadTime == 0 {
+			return
+		}
+
+		latency := event.DownloadTime.Seconds()
+		for i, bound := range latencyBuckets {
+			if latency <= bound {
+				counters.latencyBuckets[i]++
+			}
+		}
+		counters.latencySum += latency
+		counters.latencyCount++
+	})
+}
+
+// Retried counts retries by the status code of the failed attempt, retries of requests
+// failing without a response being counted with status code "none".
+func (o metricsObserver) Retried(retry request.Retry) {
+	code := "none"
+	var statusErr *request.StatusError
+	if errors.As(retry.Err, &statusErr) {
+		code = strconv.Itoa(statusErr.StatusCode)
+	}
+
+	o.metrics.update(o.streamID, func(counters *streamCounters) {
+		counters.retries[code]++
+	})
+}
+
+// metricsHandler writes the metrics of the streams in the Prometheus text format.
+func metricsHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	streamMetrics.write(writer, viewersByStream())
+}
+
+// viewersByStream returns the number of viewers of the streams being restreamed.
+func viewersByStream() map[string]int {
+	viewers := make(map[string]int)
+	for _, streamHub := range streamHubs.active() {
+		viewers[streamHub.streamID], _ = streamHub.stats()
+	}
+
+	return viewers
+}
+
+// write writes the metrics with the given viewers by stream in the Prometheus text format,
+// with the streams sorted by id.
+func (m *metrics) write(writer io.Writer, viewers map[string]int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	streamIDs := make([]string, 0, len(m.streams))
+	for streamID := range m.streams {
+		streamIDs = append(streamIDs, streamID)
+	}
+	sort.Strings(streamIDs)
+
+	activeIDs := make([]string, 0, len(viewers))
+	for streamID := range viewers {
+		activeIDs = append(activeIDs, streamID)
+	}
+	sort.Strings(activeIDs)
+
+	writeHeader(writer, "restreamer_viewers", "gauge", "Number of viewers of a stream.")
+	for _, streamID := range activeIDs {
+		fmt.Fprintf(writer, "restreamer_viewers{stream=%s} %d\n", quoteLabel(streamID), viewers[streamID])
+	}
+
+	writeHeader(writer, "restreamer_bytes_in_total", "counter", "Bytes of segments downloaded successfully.")
+	for _, streamID := range streamIDs {
+		fmt.Fprintf(writer, "restreamer_bytes_in_total{stream=%s} %d\n", quoteLabel(streamID), m.streams[streamID].bytesIn)
+	}
+
+	writeHeader(writer, "restreamer_bytes_out_total", "counter", "Bytes written to viewers.")
+	for _, streamID := range streamIDs {
+		fmt.Fprintf(writer, "restreamer_bytes_out_total{stream=%s} %d\n", quoteLabel(streamID), m.streams[streamID].bytesOut)
+	}
+
+	writeHeader(writer, "restreamer_segment_download_seconds", "histogram", "Time to download a segment.")
+	for _, streamID := range streamIDs {
+		counters := m.streams[streamID]
+		label := quoteLabel(streamID)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(writer, "restreamer_segment_download_seconds_bucket{stream=%s,le=\"%s\"} %d\n",
+				label, strconv.FormatFloat(bound, 'g', -1, 64), counters.latencyBuckets[i])
+		}
+		fmt.Fprintf(writer, "restreamer_segment_download_seconds_bucket{stream=%s,le=\"+Inf\"} %d\n", label, counters.latencyCount)
+		fmt.Fprintf(writer, "restreamer_segment_download_seconds_sum{stream=%s} %s\n", label, strconv.FormatFloat(counters.latencySum, 'g', -1, 64))
+		fmt.Fprintf(writer, "restreamer_segment_download_seconds_count{stream=%s} %d\n", label, counters.latencyCount)
+	}
+
+	writeHeader(writer, "restreamer_playlist_refresh_errors_total", "counter", "Failed playlist refreshes.")
+	for _, streamID := range streamIDs {
+		fmt.Fprintf(writer, "restreamer_playlist_refresh_errors_total{stream=%s} %d\n", quoteLabel(streamID), m.streams[streamID].playlistErrors)
+	}
+
+	writeHeader(writer, "restreamer_retries_total", "counter", "Retried requests by status code of the failed attempt.")
+	for _, streamID := range streamIDs {
+		retries := m.streams[streamID].retries
+		codes := make([]string, 0, len(retries))
+		for code := range retries {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+
+		for _, code := range codes {
+			fmt.Fprintf(writer, "restreamer_retries_total{stream=%s,code=%s} %d\n", quoteLabel(streamID), quoteLabel(code), retries[code])
+		}
+	}
+
+	writeHeader(writer, "restreamer_decrypt_failures_total", "counter", "Segments that failed to decrypt.")
+	for _, streamID := range streamIDs {
+		fmt.Fprintf(writer, "restreamer_decrypt_failures_total{stream=%s} %d\n", quoteLabel(streamID), m.streams[streamID].decryptFailures)
+	}
+
+	// The variant is only reported while the stream is being restreamed.
+	writeHeader(writer, "restreamer_variant_bandwidth_bits", "gauge", "Bandwidth of the selected variant in bits per second.")
+	for _, streamID := range activeIDs {
+		if counters, ok := m.streams[streamID]; ok && counters.hasVariant {
+			fmt.Fprintf(writer, "restreamer_variant_bandwidth_bits{stream=%s} %d\n", quoteLabel(streamID), counters.variantBandwidth)
+		}
+	}
+}
+
+func writeHeader(writer io.Writer, name, metricType, help string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
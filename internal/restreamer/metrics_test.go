@@ -0,0 +1,99 @@
+package restreamer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shaunschembri/restreamer/pkg/restream"
+	"github.com/shaunschembri/restreamer/pkg/restream/provider"
+	"github.com/shaunschembri/restreamer/pkg/restream/request"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	previous := streamMetrics
+	streamMetrics = &metrics{streams: make(map[string]*streamCounters)}
+	defer func() { streamMetrics = previous }()
+
+	streamHubs.mutex.Lock()
+	streamHubs.hubs["news"] = &hub{streamID: "news", viewers: map[*viewer]struct{}{{}: {}, {}: {}}}
+	streamHubs.mutex.Unlock()
+	defer func() {
+		streamHubs.mutex.Lock()
+		delete(streamHubs.hubs, "news")
+		streamHubs.mutex.Unlock()
+	}()
+
+	observer := streamMetrics.observer("news")
+	observer.VariantSwitched(provider.Variant{Bandwidth: 2000000})
+	observer.PlaylistRefreshed(restream.PlaylistEvent{})
+	observer.PlaylistRefreshed(restream.PlaylistEvent{Err: errors.New("playlist failed")})
+	observer.SegmentFinished(restream.SegmentEvent{Bytes: 1128, BytesDownloaded: 1000, DownloadTime: 200 * time.Millisecond})
+	observer.SegmentFinished(restream.SegmentEvent{Bytes: 1504, BytesDownloaded: 1500, DownloadTime: 3 * time.Second})
+	// Failed segments are not counted as downloaded, even if part of them was written.
+	observer.SegmentFinished(restream.SegmentEvent{Bytes: 376, Err: fmt.Errorf("segment: %w", restream.ErrDecryptionFailed)})
+	observer.SegmentFinished(restream.SegmentEvent{Segment: provider.Segment{Gap: true}})
+	observer.Retried(request.Retry{Err: &request.StatusError{StatusCode: http.StatusServiceUnavailable}})
+	observer.Retried(request.Retry{Err: &request.StatusError{StatusCode: http.StatusServiceUnavailable}})
+	observer.Retried(request.Retry{Err: errors.New("connection reset")})
+	streamMetrics.addBytesOut("news", 4096)
+
+	streamMetrics.observer(`quoted "id"`).PlaylistRefreshed(restream.PlaylistEvent{Err: errors.New("playlist failed")})
+
+	server := httptest.NewServer(http.HandlerFunc(metricsHandler))
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Fatalf("got content type %q", contentType)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(string(body), "\n") {
+		lines[line] = true
+	}
+
+	for _, want := range []string{
+		"# TYPE restreamer_bytes_in_total counter",
+		`restreamer_viewers{stream="news"} 2`,
+		`restreamer_bytes_in_total{stream="news"} 2500`,
+		`restreamer_bytes_out_total{stream="news"} 4096`,
+		`restreamer_segment_download_seconds_bucket{stream="news",le="0.1"} 0`,
+		`restreamer_segment_download_seconds_bucket{stream="news",le="0.25"} 1`,
+		`restreamer_segment_download_seconds_bucket{stream="news",le="2.5"} 1`,
+		`restreamer_segment_download_seconds_bucket{stream="news",le="5"} 2`,
+		`restreamer_segment_download_seconds_bucket{stream="news",le="+Inf"} 2`,
+		`restreamer_segment_download_seconds_sum{stream="news"} 3.2`,
+		`restreamer_segment_download_seconds_count{stream="news"} 2`,
+		`restreamer_playlist_refresh_errors_total{stream="news"} 1`,
+		`restreamer_playlist_refresh_errors_total{stream="quoted \"id\""} 1`,
+		`restreamer_retries_total{stream="news",code="503"} 2`,
+		`restreamer_retries_total{stream="news",code="none"} 1`,
+		`restreamer_decrypt_failures_total{stream="news"} 1`,
+		`restreamer_variant_bandwidth_bits{stream="news"} 2000000`,
+	} {
+		if !lines[want] {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+
+	// Streams not being restreamed have no viewers or variant.
+	if strings.Contains(string(body), `restreamer_viewers{stream="quoted \"id\""}`) ||
+		strings.Contains(string(body), `restreamer_variant_bandwidth_bits{stream="quoted \"id\""}`) {
+		t.Error("inactive stream reported as active")
+	}
+}
@@ -0,0 +1,124 @@
+package restreamer
+
+import (
+	"encoding/binary"
+)
+
+// isMP4 reports whether p starts with a top-level box of a fragmented MP4 stream.
+func isMP4(p []byte) bool {
+	if len(p) < 8 {
+		return false
+	}
+
+	switch string(p[4:8]) {
+	case "ftyp", "styp", "moov", "moof", "sidx", "emsg", "mdat":
+		return true
+	}
+
+	return false
+}
+
+// mp4Boxes tracks the top-level boxes of a fragmented MP4 stream written in chunks,
+// keeping its latest initialization section.
+type mp4Boxes struct {
+	header    []byte
+	boxType   string
+	previous  string
+	remaining int64
+	init      []byte
+	// carried holds the start of the header of the last sync point found that was written
+	// in previous chunks.
+	carried []byte
+}
+
+// scan reads the boxes of chunk and returns the offset of the first fragment whose header
+// ends in it, from which a player given the initialization section can decode the stream,
+// or -1. A sync point with a header starting in a previous chunk is at offset 0 of chunk,
+// preceded by carried.
+func (m *mp4Boxes) scan(chunk []byte) int {
+	syncPoint := -1
+	m.carried = nil
+
+	for offset := 0; offset < len(chunk); {
+		if m.boxType == "" {
+			for len(m.header) < m.headerLength() && offset < len(chunk) {
+				m.header = append(m.header, chunk[offset])
+				offset++
+			}
+			if len(m.header) < m.headerLength() {
+				break
+			}
+
+			start := offset - len(m.header)
+			if start < 0 {
+				m.carried = append([]byte(nil), m.header[:-start]...)
+				start = 0
+			}
+			m.startBox()
+			if (m.boxType == "styp" || m.boxType == "moof") && m.previous != "styp" && syncPoint < 0 {
+				syncPoint = start
+			} else if syncPoint < 0 {
+				m.carried = nil
+			}
+			continue
+		}
+
+		n := int64(len(chunk) - offset)
+		if m.remaining >= 0 && m.remaining < n {
+			n = m.remaining
+		}
+		if m.boxType == "ftyp" || m.boxType == "moov" {
+			m.init = append(m.init, chunk[offset:offset+int(n)]...)
+		}
+
+		offset += int(n)
+		if m.remaining > 0 {
+			m.remaining -= n
+		}
+		if m.remaining == 0 {
+			m.endBox()
+		}
+	}
+
+	return syncPoint
+}
+
+func (m *mp4Boxes) headerLength() int {
+	if len(m.header) >= 4 && binary.BigEndian.Uint32(m.header) == 1 {
+		return 16
+	}
+
+	return 8
+}
+
+// startBox starts the box of the header read. A box extending to the end of the stream
+// has -1 bytes remaining.
+func (m *mp4Boxes) startBox() {
+	m.boxType = string(m.header[4:8])
+
+	size := int64(binary.BigEndian.Uint32(m.header))
+	if size == 1 {
+		size = int64(binary.BigEndian.Uint64(m.header[8:16]))
+	}
+	m.remaining = size - int64(len(m.header))
+	if size == 0 || m.remaining < 0 {
+		m.remaining = -1
+	}
+
+	switch {
+	case m.boxType == "ftyp", m.boxType == "moov" && m.previous != "ftyp":
+		m.init = append([]byte(nil), m.header...)
+	case m.boxType == "moov":
+		m.init = append(m.init, m.header...)
+	}
+
+	m.header = m.header[:0]
+	if m.remaining == 0 {
+		m.endBox()
+	}
+}
+
+func (m *mp4Boxes) endBox() {
+	m.previous = m.boxType
+	m.boxType = ""
+}
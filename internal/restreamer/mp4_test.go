@@ -0,0 +1,133 @@
+package restreamer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func box(boxType string, payload []byte) []byte {
+	data := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(8+len(payload)))
+	copy(data[4:], boxType)
+
+	return append(data, payload...)
+}
+
+// largeBox returns a box with its size in the 64-bit largesize field.
+func largeBox(boxType string, payload []byte) []byte {
+	data := make([]byte, 16, 16+len(payload))
+	binary.BigEndian.PutUint32(data, 1)
+	copy(data[4:], boxType)
+	binary.BigEndian.PutUint64(data[8:], uint64(16+len(payload)))
+
+	return append(data, payload...)
+}
+
+// scanChunks scans data split in chunks of size bytes, returning the offsets in data of
+// the sync points found.
+func scanChunks(boxes *mp4Boxes, data []byte, size int) []int {
+	syncPoints := make([]int, 0)
+	for offset := 0; offset < len(data); offset += size {
+		end := offset + size
+		if end > len(data) {
+			end = len(data)
+		}
+		if syncPoint := boxes.scan(data[offset:end]); syncPoint >= 0 {
+			syncPoints = append(syncPoints, offset+syncPoint-len(boxes.carried))
+		}
+	}
+
+	return syncPoints
+}
+
+func TestMP4BoxesScan(t *testing.T) {
+	ftyp := box("ftyp", []byte("iso6"))
+	moov := box("moov", bytes.Repeat([]byte{1}, 40))
+	fragment := append(box("moof", bytes.Repeat([]byte{2}, 30)), largeBox("mdat", bytes.Repeat([]byte{3}, 50))...)
+	styled := append(box("styp", []byte("msdh")), fragment...)
+
+	var data []byte
+	data = append(data, ftyp...)
+	data = append(data, moov...)
+	data = append(data, fragment...)
+	data = append(data, styled...)
+	data = append(data, fragment...)
+
+	first := len(ftyp) + len(moov)
+	second := first + len(fragment)
+	third := second + len(styled)
+
+	for _, size := range []int{len(data), 200, 13, 1} {
+		boxes := &mp4Boxes{}
+		syncPoints := scanChunks(boxes, data, size)
+
+		if !bytes.Equal(boxes.init, append(append([]byte(nil), ftyp...), moov...)) {
+			t.Fatalf("chunks of %d bytes: got initialization section of %d bytes", size, len(boxes.init))
+		}
+
+		// A chunk returns the first sync point whose header ends in it, the moof following
+		// a styp not being one.
+		var want []int
+		for _, syncPoint := range []int{first, second, third} {
+			if len(want) == 0 || (syncPoint+7)/size != (want[len(want)-1]+7)/size {
+				want = append(want, syncPoint)
+			}
+		}
+		if !reflect.DeepEqual(syncPoints, want) {
+			t.Fatalf("chunks of %d bytes: got sync points %v, want %v", size, syncPoints, want)
+		}
+	}
+}
+
+func TestMP4BoxesNewInit(t *testing.T) {
+	boxes := &mp4Boxes{}
+	boxes.scan(append(box("ftyp", []byte("iso6")), box("moov", []byte("first"))...))
+
+	// A moov after fragments, like after a variant switch, replaces the initialization
+	// section.
+	moov := box("moov", []byte("second"))
+	boxes.scan(append(box("moof", nil), moov...))
+	if !bytes.Equal(boxes.init, moov) {
+		t.Fatalf("got initialization section %q", boxes.init)
+	}
+}
+
+func TestHubLateViewerFMP4(t *testing.T) {
+	init := append(box("ftyp", []byte("iso6")), box("moov", bytes.Repeat([]byte{1}, 40))...)
+	fragment := func(value byte) []byte {
+		return append(box("moof", []byte{value}), box("mdat", bytes.Repeat([]byte{value}, 300))...)
+	}
+
+	streamHub := newTestHub()
+	streamHub.attach()
+	first := append(append([]byte(nil), init...), fragment(2)...)
+	streamHub.Write(first[:len(first)-100])
+
+	late := streamHub.attach()
+	second := append(first[len(first)-100:], fragment(3)...)
+	streamHub.Write(second)
+
+	// The header of the next fragment is split between two chunks.
+	third := fragment(4)
+	lateSplit := streamHub.attach()
+	streamHub.Write(third[:3])
+	streamHub.Write(third[3:])
+
+	chunks := received(late)
+	if len(chunks) != 3 {
+		t.Fatalf("late viewer got %d chunks, want 3", len(chunks))
+	}
+	if want := append(append([]byte(nil), init...), fragment(3)...); !bytes.Equal(chunks[0], want) {
+		t.Fatal("late viewer did not get the initialization section followed by the next fragment")
+	}
+
+	chunks = received(lateSplit)
+	if len(chunks) != 1 {
+		t.Fatalf("viewer joining before a split header got %d chunks, want 1", len(chunks))
+	}
+	if want := append(append([]byte(nil), init...), third...); !bytes.Equal(chunks[0], want) {
+		t.Fatal("viewer joining before a split header did not get the whole fragment")
+	}
+}
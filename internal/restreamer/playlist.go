@@ -0,0 +1,36 @@
+package restreamer
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+func playlistHandler(writer http.ResponseWriter, request *http.Request) {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+
+	for _, stream := range getStreams() {
+		playlist.WriteString("#EXTINF:-1")
+		writeM3UAttribute(&playlist, "tvg-id", stream.ID)
+		writeM3UAttribute(&playlist, "tvg-name", stream.Name)
+		writeM3UAttribute(&playlist, "tvg-logo", stream.Logo)
+		writeM3UAttribute(&playlist, "group-title", stream.Group)
+		writeM3UAttribute(&playlist, "tvg-chno", stream.Channel)
+		playlist.WriteString(fmt.Sprintf(",%s\n%s/%s\n", stream.Name, baseURL(request), stream.ID))
+	}
+
+	writer.Header().Set("Content-Type", "audio/x-mpegurl")
+	if _, err := writer.Write([]byte(playlist.String())); err != nil {
+		log.Printf("Error writing playlist: %v", err)
+	}
+}
+
+// M3U has no escaping mechanism so double quotes inside attribute values are replaced.
+func writeM3UAttribute(playlist *strings.Builder, name, value string) {
+	if value == "" {
+		return
+	}
+	playlist.WriteString(fmt.Sprintf(` %s="%s"`, name, strings.ReplaceAll(value, `"`, "'")))
+}
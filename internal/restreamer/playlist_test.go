@@ -0,0 +1,44 @@
+package restreamer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// setStreams sets the streams section of the config until the end of the test.
+func setStreams(t *testing.T, streams map[string]interface{}) {
+	viper.Set("streams", streams)
+	t.Cleanup(func() { viper.Set("streams", nil) })
+}
+
+func TestPlaylistHandler(t *testing.T) {
+	setStreams(t, map[string]interface{}{
+		"news": map[string]interface{}{
+			"url":     "http://example.com/news.m3u8",
+			"name":    `The "News"`,
+			"logo":    "http://example.com/news.png",
+			"group":   "Info",
+			"channel": "101",
+		},
+		"plain": "http://example.com/plain.m3u8",
+	})
+
+	recorder := httptest.NewRecorder()
+	playlistHandler(recorder, httptest.NewRequest(http.MethodGet, "http://restreamer:8080/playlist.m3u", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "audio/x-mpegurl" {
+		t.Fatalf("got content type %q", contentType)
+	}
+
+	want := "#EXTM3U\n" +
+		`#EXTINF:-1 tvg-id="news" tvg-name="The 'News'" tvg-logo="http://example.com/news.png" group-title="Info" tvg-chno="101",The "News"` + "\n" +
+		"http://restreamer:8080/news\n" +
+		`#EXTINF:-1 tvg-id="plain" tvg-name="plain",plain` + "\n" +
+		"http://restreamer:8080/plain\n"
+	if recorder.Body.String() != want {
+		t.Fatalf("got playlist\n%s\nwant\n%s", recorder.Body.String(), want)
+	}
+}
@@ -4,30 +4,180 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/spf13/viper"
 
 	"github.com/shaunschembri/restreamer/pkg/restream"
+	"github.com/shaunschembri/restreamer/pkg/restream/provider"
+	"github.com/shaunschembri/restreamer/pkg/restream/request"
 )
 
 const mbMultiplier = 1048576
 
-func start(ctx context.Context, writer io.Writer, streamID string) error {
+// startOptions hold the settings of a restream that depend on how its output is used.
+type startOptions struct {
+	// maxLiveDuration stops live streams after the given duration unless it is zero.
+	maxLiveDuration time.Duration
+	// audioWriter and subtitleWriter receive the segments of the alternate audio and
+	// subtitles renditions. Renditions without a writer are not downloaded.
+	audioWriter    io.Writer
+	subtitleWriter io.Writer
+	// started is called with the restream before it starts, for example to read its stats
+	// while it runs.
+	started func(streamer *restream.Restream)
+}
+
+// start restreams streamID to writer.
+func start(ctx context.Context, writer io.Writer, streamID string, options startOptions) error {
+	stream, err := getStream(streamID)
+	if err != nil {
+		return err
+	}
+
+	maxBandwidth := stream.MaxBandwidth
+	if maxBandwidth == 0 {
+		maxBandwidth = viper.GetFloat64("max-bandwidth")
+	}
+
+	readBuffer := stream.ReadBuffer
+	if readBuffer == 0 {
+		readBuffer = viper.GetFloat64("read-buffer")
+	}
+
+	concurrency := stream.Concurrency
+	if concurrency == 0 {
+		concurrency = viper.GetInt("concurrency")
+	}
+
+	remux := viper.GetBool("remux")
+	if stream.Remux != nil {
+		remux = *stream.Remux
+	}
+
+	normalize := viper.GetBool("normalize")
+	if stream.Normalize != nil {
+		normalize = *stream.Normalize
+	}
+
+	headers := make(http.Header)
+	for name, value := range stream.Headers {
+		headers.Set(name, value)
+	}
+
+	requestOptions := []request.Option{
+		request.WithRetryPolicy(retryPolicy()),
+		request.WithHeaders(headers),
+		request.WithAuthHosts(stream.AuthHosts...),
+	}
+	if stream.Username != "" || stream.Password != "" {
+		requestOptions = append(requestOptions, request.WithBasicAuth(stream.Username, stream.Password))
+	}
+	if stream.BearerToken != "" {
+		requestOptions = append(requestOptions, request.WithBearerToken(stream.BearerToken))
+	}
+
+	httpClient, err := request.NewClientWithConfig(transportConfig(stream))
+	if err != nil {
+		return fmt.Errorf("invalid transport config for stream with id %s: %w", streamID, err)
+	}
+	// Every restream has its own client so its connections are closed once it stops.
+	defer httpClient.CloseIdleConnections()
+
 	streamer := restream.Restream{
-		Writer:         writer,
-		MaxBandwidth:   uint32(viper.GetFloat64("max-bandwidth") * mbMultiplier),
-		ReadBufferSize: int(viper.GetFloat64("read-buffer") * mbMultiplier),
+		Writer:          writer,
+		AudioWriter:     options.audioWriter,
+		SubtitleWriter:  options.subtitleWriter,
+		Remux:           remux,
+		Normalize:       normalize,
+		UserAgent:       stream.UserAgent,
+		RequestOptions:  requestOptions,
+		HTTPClient:      httpClient,
+		KeyOverrides:    stream.Keys,
+		MaxLiveDuration: options.maxLiveDuration,
+		MaxBandwidth:    uint32(maxBandwidth * mbMultiplier),
+		ReadBufferSize:  int(readBuffer * mbMultiplier),
+		Concurrency:     concurrency,
+		Observer:        streamMetrics.observer(streamID),
+		Variant: provider.VariantPreference{
+			MaxHeight:    stream.Variant.MaxHeight,
+			MinBandwidth: uint32(stream.Variant.MinBandwidth * mbMultiplier),
+			Audio:        renditionPreference(stream.Audio, "audio"),
+			Subtitles:    renditionPreference(stream.Subtitles, "subtitles"),
+		},
 	}
 
-	streams := viper.GetStringMapString("streams")
-	streamURL, ok := streams[streamID]
-	if !ok {
-		return fmt.Errorf("url for stream with id %s not found in config", streamID)
+	if options.started != nil {
+		options.started(&streamer)
 	}
 
-	if err := streamer.Start(ctx, streamURL); err != nil {
+	if err := streamer.Start(ctx, stream.URL); err != nil {
 		return fmt.Errorf("restreamer error %w", err)
 	}
 
 	return nil
 }
+
+// renditionPreference returns the rendition preference of a stream, falling back to the
+// global preference in the configKey section of the config.
+func renditionPreference(rendition renditionConfig, configKey string) provider.RenditionPreference {
+	if len(rendition.Languages) == 0 && rendition.Name == "" {
+		rendition.Languages = viper.GetStringSlice(configKey + ".languages")
+		rendition.Name = viper.GetString(configKey + ".name")
+	}
+
+	return provider.RenditionPreference{
+		Languages: rendition.Languages,
+		Name:      rendition.Name,
+	}
+}
+
+// retryPolicy returns the default retry policy with the values set in the retry section
+// of the config.
+func retryPolicy() request.RetryPolicy {
+	policy := request.DefaultRetryPolicy()
+	if viper.IsSet("retry.max-attempts") {
+		policy.MaxAttempts = viper.GetInt("retry.max-attempts")
+	}
+	if viper.IsSet("retry.max-elapsed-time") {
+		policy.MaxElapsedTime = viper.GetDuration("retry.max-elapsed-time")
+	}
+	if viper.IsSet("retry.initial-backoff") {
+		policy.InitialBackoff = viper.GetDuration("retry.initial-backoff")
+	}
+	if viper.IsSet("retry.max-backoff") {
+		policy.MaxBackoff = viper.GetDuration("retry.max-backoff")
+	}
+	for code := range viper.GetStringMap("retry.status-code-attempts") {
+		statusCode, err := strconv.Atoi(code)
+		if err != nil {
+			continue
+		}
+		policy.StatusCodeAttempts[statusCode] = viper.GetInt("retry.status-code-attempts." + code)
+	}
+
+	return policy
+}
+
+// transportConfig returns the proxy and TLS settings of the stream, falling back to the
+// global settings for the ones not set for the stream.
+func transportConfig(stream streamConfig) request.TransportConfig {
+	config := stream.Transport
+	if config.ProxyURL == "" {
+		config.ProxyURL = viper.GetString("proxy")
+	}
+	if config.CAFile == "" {
+		config.CAFile = viper.GetString("tls.ca-file")
+	}
+	if config.CertFile == "" && config.KeyFile == "" {
+		config.CertFile = viper.GetString("tls.cert-file")
+		config.KeyFile = viper.GetString("tls.key-file")
+	}
+	if !config.InsecureSkipVerify {
+		config.InsecureSkipVerify = viper.GetBool("tls.insecure-skip-verify")
+	}
+
+	return config
+}
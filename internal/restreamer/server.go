@@ -1,6 +1,7 @@
 package restreamer
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,12 +14,19 @@ var serverCmd = &cobra.Command{
 	Use:   "server",
 	Short: "Start HTTP server",
 	Run: func(cmd *cobra.Command, args []string) {
+		go importedStreams.watch(context.Background())
+
 		addr := fmt.Sprintf("%s:%d", viper.GetString("server.address"), viper.GetInt("server.port"))
 
-		http.HandleFunc("/", httpStream)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", httpStream)
+		mux.HandleFunc("/playlist.m3u", playlistHandler)
+		mux.HandleFunc("/stats", statsHandler)
+		mux.HandleFunc("/metrics", metricsHandler)
+		registerHDHomeRun(mux)
 
 		log.Printf("Starting HTTP server on %s", addr)
-		if err := http.ListenAndServe(addr, nil); err != nil {
+		if err := http.ListenAndServe(addr, mux); err != nil {
 			log.Fatalln(err)
 		}
 	},
@@ -36,12 +44,37 @@ func init() {
 
 func httpStream(writer http.ResponseWriter, request *http.Request) {
 	streamID := request.URL.Path[1:]
-
-	log.Printf("Starting to restream stream with id %s", streamID)
-	if err := start(request.Context(), writer, streamID); err != nil {
-		log.Println(err.Error())
+	if _, err := getStream(streamID); err != nil {
+		http.NotFound(writer, request)
 		return
 	}
 
-	log.Printf("Restream of stream with id %s stopped", streamID)
+	streamHub, streamViewer := streamHubs.join(streamID)
+	defer streamHubs.leave(streamHub, streamViewer)
+
+	log.Printf("Viewer from %s joined stream with id %s", request.RemoteAddr, streamID)
+	for {
+		select {
+		case <-request.Context().Done():
+			log.Printf("Viewer from %s left stream with id %s", request.RemoteAddr, streamID)
+			return
+		case chunk, ok := <-streamViewer.data:
+			if !ok {
+				return
+			}
+
+			written, err := writer.Write(chunk)
+			streamMetrics.addBytesOut(streamID, written)
+			if err != nil {
+				log.Printf("Error writing to viewer from %s: %v", request.RemoteAddr, err)
+				return
+			}
+
+			// Chunks are sent to the viewer as they are written instead of once the
+			// response buffer fills up.
+			if flusher, ok := writer.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+	}
 }
@@ -0,0 +1,67 @@
+package restreamer
+
+import (
+	"net/http"
+	"time"
+)
+
+type streamStats struct {
+	Viewers            int          `json:"viewers"`
+	StartTime          time.Time    `json:"start_time"`
+	UptimeSeconds      float64      `json:"uptime_seconds"`
+	BytesStreamed      int64        `json:"bytes_streamed"`
+	SegmentsFetched    int64        `json:"segments_fetched"`
+	SegmentsFailed     int64        `json:"segments_failed"`
+	SegmentRetries     int64        `json:"segment_retries"`
+	Bandwidth          uint32       `json:"bandwidth"`
+	Variant            *variantInfo `json:"variant,omitempty"`
+	Live               bool         `json:"live"`
+	LiveLatencySeconds *float64     `json:"live_latency_seconds,omitempty"`
+}
+
+type variantInfo struct {
+	URL        string `json:"url"`
+	Bandwidth  uint32 `json:"bandwidth"`
+	Resolution string `json:"resolution,omitempty"`
+	Audio      string `json:"audio,omitempty"`
+	Subtitles  string `json:"subtitles,omitempty"`
+}
+
+// statsHandler writes the stats of the streams being restreamed keyed by stream id.
+// Bandwidths are in bits per second.
+func statsHandler(writer http.ResponseWriter, request *http.Request) {
+	stats := make(map[string]streamStats)
+
+	for _, streamHub := range streamHubs.active() {
+		viewers, restreamStats := streamHub.stats()
+		entry := streamStats{
+			Viewers:         viewers,
+			StartTime:       restreamStats.StartTime,
+			UptimeSeconds:   restreamStats.Uptime.Seconds(),
+			BytesStreamed:   restreamStats.BytesStreamed,
+			SegmentsFetched: restreamStats.SegmentsFetched,
+			SegmentsFailed:  restreamStats.SegmentsFailed,
+			SegmentRetries:  restreamStats.SegmentRetries,
+			Bandwidth:       restreamStats.Bandwidth,
+			Live:            restreamStats.Live,
+		}
+		if restreamStats.Live {
+			latency := restreamStats.LiveLatency.Seconds()
+			entry.LiveLatencySeconds = &latency
+		}
+
+		if variant := restreamStats.Variant; variant != nil {
+			entry.Variant = &variantInfo{
+				URL:        variant.URL,
+				Bandwidth:  variant.Bandwidth,
+				Resolution: variant.Resolution,
+				Audio:      variant.Audio,
+				Subtitles:  variant.Subtitles,
+			}
+		}
+
+		stats[streamHub.streamID] = entry
+	}
+
+	writeJSON(writer, stats)
+}
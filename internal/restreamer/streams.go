@@ -0,0 +1,181 @@
+package restreamer
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/viper"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/request"
+)
+
+// streamConfig holds the configuration of a single entry in the streams section of
+// the config. An entry can either be a plain URL or a map holding the URL, the stream
+// metadata and settings overriding the global ones for this stream.
+type streamConfig struct {
+	ID           string
+	URL          string
+	Name         string
+	Logo         string
+	Group        string
+	Channel      string
+	UserAgent    string
+	Headers      map[string]string
+	Username     string
+	Password     string
+	BearerToken  string
+	AuthHosts    []string
+	Transport    request.TransportConfig
+	Keys         map[string]string
+	MaxBandwidth float64
+	ReadBuffer   float64
+	Concurrency  int
+	Remux        *bool
+	Normalize    *bool
+	Variant      variantConfig
+	Audio        renditionConfig
+	Subtitles    renditionConfig
+}
+
+// variantConfig holds the variant preferences of a stream, bandwidth is in mb/sec.
+type variantConfig struct {
+	MaxHeight    int
+	MinBandwidth float64
+}
+
+// renditionConfig holds the preferred languages or name of an alternate rendition.
+type renditionConfig struct {
+	Languages []string
+	Name      string
+}
+
+func getStream(streamID string) (streamConfig, error) {
+	key := "streams." + streamID
+	if !viper.IsSet(key) {
+		if stream, ok := importedStreams.get(streamID); ok {
+			return stream, nil
+		}
+
+		return streamConfig{}, fmt.Errorf("stream with id %s not found in config", streamID)
+	}
+
+	stream := streamConfig{
+		ID:   streamID,
+		Name: streamID,
+	}
+
+	if streamURL, ok := viper.Get(key).(string); ok {
+		stream.URL = streamURL
+		return stream, nil
+	}
+
+	config := viper.Sub(key)
+	if config == nil {
+		return streamConfig{}, fmt.Errorf("invalid config for stream with id %s", streamID)
+	}
+
+	stream.URL = config.GetString("url")
+	stream.Logo = config.GetString("logo")
+	stream.Group = config.GetString("group")
+	stream.Channel = config.GetString("channel")
+	stream.UserAgent = config.GetString("user-agent")
+	stream.Headers = config.GetStringMapString("headers")
+	stream.Username = config.GetString("username")
+	stream.Password = config.GetString("password")
+	stream.BearerToken = config.GetString("bearer-token")
+	stream.AuthHosts = config.GetStringSlice("auth-hosts")
+	stream.Transport = request.TransportConfig{
+		ProxyURL:           config.GetString("proxy"),
+		CAFile:             config.GetString("tls.ca-file"),
+		CertFile:           config.GetString("tls.cert-file"),
+		KeyFile:            config.GetString("tls.key-file"),
+		InsecureSkipVerify: config.GetBool("tls.insecure-skip-verify"),
+	}
+	stream.Keys = keyOverrides(config.Get("keys"))
+	stream.MaxBandwidth = config.GetFloat64("max-bandwidth")
+	stream.ReadBuffer = config.GetFloat64("read-buffer")
+	stream.Concurrency = config.GetInt("concurrency")
+	if config.IsSet("remux") {
+		remux := config.GetBool("remux")
+		stream.Remux = &remux
+	}
+	if config.IsSet("normalize") {
+		normalize := config.GetBool("normalize")
+		stream.Normalize = &normalize
+	}
+	stream.Variant.MaxHeight = config.GetInt("variant.max-height")
+	stream.Variant.MinBandwidth = config.GetFloat64("variant.min-bandwidth")
+	stream.Audio = renditionConfig{
+		Languages: config.GetStringSlice("audio.languages"),
+		Name:      config.GetString("audio.name"),
+	}
+	stream.Subtitles = renditionConfig{
+		Languages: config.GetStringSlice("subtitles.languages"),
+		Name:      config.GetString("subtitles.name"),
+	}
+	if name := config.GetString("name"); name != "" {
+		stream.Name = name
+	}
+
+	if stream.URL == "" {
+		return streamConfig{}, fmt.Errorf("url for stream with id %s not found in config", streamID)
+	}
+
+	return stream, nil
+}
+
+// keyOverrides parses a list of uri and key pairs. A list is used instead of a map as
+// the config keys are case insensitive while URIs are not.
+func keyOverrides(config interface{}) map[string]string {
+	overrides := make(map[string]string)
+
+	entries, ok := config.([]interface{})
+	if !ok {
+		return overrides
+	}
+
+	for _, entry := range entries {
+		var uri, key interface{}
+		switch entry := entry.(type) {
+		case map[interface{}]interface{}:
+			uri, key = entry["uri"], entry["key"]
+		case map[string]interface{}:
+			uri, key = entry["uri"], entry["key"]
+		}
+
+		uriString, uriOK := uri.(string)
+		keyString, keyOK := key.(string)
+		if uriOK && keyOK {
+			overrides[uriString] = keyString
+		}
+	}
+
+	return overrides
+}
+
+// getStreams returns the streams configured in the config together with the streams
+// imported from channel lists, sorted by stream id.
+func getStreams() []streamConfig {
+	streams := importedStreams.all()
+	for _, streamID := range streamIDs() {
+		stream, err := getStream(streamID)
+		if err != nil {
+			continue
+		}
+		streams = append(streams, stream)
+	}
+
+	sort.Slice(streams, func(i, j int) bool { return streams[i].ID < streams[j].ID })
+
+	return streams
+}
+
+func streamIDs() []string {
+	streams := viper.GetStringMap("streams")
+	ids := make([]string, 0, len(streams))
+	for id := range streams {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
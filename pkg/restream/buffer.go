@@ -0,0 +1,95 @@
+package restream
+
+import (
+	"io"
+	"sync"
+)
+
+// segmentBufferLimit is the most data of a segment held in memory until it is written.
+const segmentBufferLimit = 67108864
+
+// segmentBuffer holds a segment while it is downloaded. It can be read while it is being
+// written, a read blocking until more data is written or the download ends. Data is
+// released as soon as it is read, and writes block while limit bytes are waiting to be
+// read, so that a download ahead of the segments being written does not fill the memory.
+type segmentBuffer struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	data   []byte
+	limit  int
+	err    error
+	closed bool
+}
+
+func newSegmentBuffer(limit int) *segmentBuffer {
+	buffer := &segmentBuffer{limit: limit}
+	buffer.cond = sync.NewCond(&buffer.mutex)
+
+	return buffer
+}
+
+// Write returns the error the buffer was closed with, if it was closed before all of p
+// was buffered.
+func (b *segmentBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	written := 0
+	for written < len(p) {
+		for len(b.data) >= b.limit && !b.closed {
+			b.cond.Wait()
+		}
+		if b.closed {
+			return written, b.err
+		}
+
+		n := len(p) - written
+		if n > b.limit-len(b.data) {
+			n = b.limit - len(b.data)
+		}
+		b.data = append(b.data, p[written:written+n]...)
+		written += n
+		b.cond.Broadcast()
+	}
+
+	return written, nil
+}
+
+// closeWithError ends the download. Reads return err, or io.EOF if err is nil, once all
+// the data written has been read. Only the first call has an effect.
+func (b *segmentBuffer) closeWithError(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	b.err = err
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+func (b *segmentBuffer) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for len(b.data) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+
+	if len(b.data) == 0 {
+		return 0, b.err
+	}
+
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	if len(b.data) == 0 {
+		b.data = nil
+	}
+	b.cond.Broadcast()
+
+	return n, nil
+}
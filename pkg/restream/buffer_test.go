@@ -0,0 +1,76 @@
+package restream
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSegmentBufferLimit(t *testing.T) {
+	buffer := newSegmentBuffer(4)
+
+	written := make(chan int)
+	go func() {
+		n, _ := buffer.Write([]byte("0123456789"))
+		written <- n
+	}()
+
+	// The write blocks until the data over the limit is read.
+	p := make([]byte, 10)
+	var read []byte
+	for len(read) < 10 {
+		select {
+		case n := <-written:
+			t.Fatalf("write of %d bytes returned before being read", n)
+		default:
+		}
+
+		n, err := buffer.Read(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 4 {
+			t.Fatalf("read %d bytes from a buffer limited to 4", n)
+		}
+		read = append(read, p[:n]...)
+	}
+
+	if n := <-written; n != 10 || string(read) != "0123456789" {
+		t.Fatalf("wrote %d bytes, read %q", n, read)
+	}
+
+	buffer.closeWithError(nil)
+	if _, err := buffer.Read(p); !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v after the end of the download", err)
+	}
+}
+
+func TestSegmentBufferCloseUnblocksWrite(t *testing.T) {
+	buffer := newSegmentBuffer(4)
+	stopped := errors.New("stopped")
+
+	result := make(chan error)
+	go func() {
+		_, err := buffer.Write([]byte("0123456789"))
+		result <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	buffer.closeWithError(stopped)
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, stopped) {
+			t.Fatalf("got error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write still blocked after closing the buffer")
+	}
+
+	// The data buffered before closing is still read, followed by the error.
+	data, err := io.ReadAll(buffer)
+	if string(data) != "0123" || !errors.Is(err, stopped) {
+		t.Fatalf("read %q, %v", data, err)
+	}
+}
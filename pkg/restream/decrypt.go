@@ -4,7 +4,10 @@ import (
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -12,18 +15,59 @@ import (
 	"github.com/shaunschembri/restreamer/pkg/restream/request"
 )
 
+// initKeyOverrides converts the keys in hex of KeyOverrides to data URIs. Overrides
+// without a scheme must be keys in hex.
+func (r *Restream) initKeyOverrides() error {
+	r.keyOverrides = make(map[string]string, len(r.KeyOverrides))
+	for uri, override := range r.KeyOverrides {
+		if strings.Contains(override, ":") {
+			r.keyOverrides[uri] = override
+			continue
+		}
+
+		key, err := hex.DecodeString(strings.TrimPrefix(override, "0x"))
+		if err != nil || len(key) != aes.BlockSize {
+			return fmt.Errorf("key override of %s is neither a URL nor a %d byte key in hex", uri, aes.BlockSize)
+		}
+		r.keyOverrides[uri] = "data:;base64," + base64.StdEncoding.EncodeToString(key)
+	}
+
+	return nil
+}
+
+// keyURL returns the URL of the key identified by uri, replaced by its key override if
+// there is one. Only key overrides can read keys from local files.
+func (r *Restream) keyURL(uri string) (string, error) {
+	if override, ok := r.keyOverrides[uri]; ok {
+		return override, nil
+	}
+
+	if strings.HasPrefix(strings.ToLower(uri), "file:") {
+		return "", fmt.Errorf("key URI %s of the playlist cannot be a local file", uri)
+	}
+
+	return uri, nil
+}
+
+// ErrDecryptionFailed is wrapped by errors caused by payloads that cannot be decrypted
+// with the key, as opposed to errors reading the payload.
+var ErrDecryptionFailed = errors.New("decryption failed")
+
 type decrypter interface {
-	decrypt([]byte) ([]byte, error)
 	init(ctx context.Context) error
+	reader(source io.Reader) io.Reader
+	invalidate()
 	info() string
 }
 
 type aes128 struct {
-	iv         string
-	keyURL     string
-	bufferSize int
-	request    request.Request
-	mode       cipher.BlockMode
+	iv            string
+	mediaSequence uint64
+	keyURL        string
+	keys          *KeyCache
+	request       request.Request
+	block         cipher.Block
+	ivBytes       []byte
 }
 
 func (a aes128) info() string {
@@ -31,57 +75,145 @@ func (a aes128) info() string {
 }
 
 func (a *aes128) init(ctx context.Context) error {
-	keyFileResponse, err := a.request.Do(ctx, a.keyURL)
+	key, err := a.keys.get(ctx, a.request, a.keyURL)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return err
 	}
-	defer keyFileResponse.Body.Close()
 
-	key, err := io.ReadAll(keyFileResponse.Body)
+	a.block, err = aes.NewCipher(key)
 	if err != nil {
-		return fmt.Errorf("cannot read key from %s: %w", a.keyURL, err)
+		a.invalidate()
+		return fmt.Errorf("cannot create new AES cipher: %w", err)
 	}
 
-	block, err := aes.NewCipher(key)
+	a.ivBytes, err = a.initializationVector()
 	if err != nil {
-		return fmt.Errorf("cannot create new AES cipher: %w", err)
+		return err
 	}
 
-	iv, err := hex.DecodeString(fmt.Sprintf("%032s", strings.ReplaceAll(a.iv, "0x", "")))
+	return nil
+}
+
+// initializationVector returns the IV of the EXT-X-KEY tag or, if the tag has no IV,
+// the media sequence number of the segment as a 128-bit big-endian integer as specified
+// in https://tools.ietf.org/html/rfc8216#section-5.2
+func (a *aes128) initializationVector() ([]byte, error) {
+	if a.iv == "" {
+		iv := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], a.mediaSequence)
+		return iv, nil
+	}
+
+	hexIV := strings.TrimPrefix(strings.TrimPrefix(a.iv, "0x"), "0X")
+	if len(hexIV) > aes.BlockSize*2 {
+		return nil, fmt.Errorf("IV %s is longer than %d bytes", a.iv, aes.BlockSize)
+	}
+
+	iv, err := hex.DecodeString(fmt.Sprintf("%032s", hexIV))
 	if err != nil {
-		return fmt.Errorf("cannot decode IV %s: %w", iv, err)
+		return nil, fmt.Errorf("cannot decode IV %s: %w", a.iv, err)
 	}
 
-	a.mode = cipher.NewCBCDecrypter(block, iv)
+	return iv, nil
+}
+
+// invalidate removes the key from the cache so that it is fetched again for the next segment.
+func (a *aes128) invalidate() {
+	a.keys.Invalidate(a.keyURL)
+}
+
+// reader returns a reader decrypting source. As each segment is encrypted as a whole,
+// a new reader has to be created for every segment.
+func (a *aes128) reader(source io.Reader) io.Reader {
+	return &cbcReader{
+		source: source,
+		mode:   cipher.NewCBCDecrypter(a.block, a.ivBytes),
+		chunk:  make([]byte, decrypterBuffer),
+	}
+}
+
+// cbcReader decrypts an AES-CBC encrypted stream, holding back the last block read until it
+// is known whether it is the final block, which holds the PKCS#7 padding.
+type cbcReader struct {
+	source    io.Reader
+	mode      cipher.BlockMode
+	chunk     []byte
+	pending   []byte
+	decrypted []byte
+	eof       bool
+}
+
+func (c *cbcReader) Read(p []byte) (int, error) {
+	for len(c.decrypted) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+
+		if err := c.fill(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.decrypted)
+	c.decrypted = c.decrypted[n:]
+
+	return n, nil
+}
+
+func (c *cbcReader) fill() error {
+	n, err := c.source.Read(c.chunk)
+	c.pending = append(c.pending, c.chunk[:n]...)
+
+	if errors.Is(err, io.EOF) {
+		c.eof = true
+		return c.decryptFinal()
+	}
+	if err != nil {
+		return err
+	}
+
+	// The last block is held back unless more bytes follow it.
+	size := len(c.pending) - len(c.pending)%aes.BlockSize
+	if size == len(c.pending) {
+		size -= aes.BlockSize
+	}
+	if size <= 0 {
+		return nil
+	}
+
+	c.decrypted = make([]byte, size)
+	c.mode.CryptBlocks(c.decrypted, c.pending[:size])
+	c.pending = append(c.pending[:0], c.pending[size:]...)
 
 	return nil
 }
 
-func (a *aes128) decrypt(payload []byte) ([]byte, error) {
-	payloadSize := len(payload)
-	if payloadSize%aes.BlockSize != 0 {
-		return nil, fmt.Errorf("payload size is not a multiple of %d", aes.BlockSize)
+func (c *cbcReader) decryptFinal() error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	if len(c.pending)%aes.BlockSize != 0 {
+		return fmt.Errorf("%w: encrypted payload size is not a multiple of %d", ErrDecryptionFailed, aes.BlockSize)
 	}
 
-	// Decrypt payload
-	a.mode.CryptBlocks(payload, payload)
+	decrypted := make([]byte, len(c.pending))
+	c.mode.CryptBlocks(decrypted, c.pending)
+	c.pending = nil
 
-	// If last byte in payload is bigger then the block size (16) or the last byte
-	// is not a multiple of 4, then there is no padding and the entire decrypted payload
-	// is returned.
-	lastByte := int(payload[payloadSize-1])
-	if lastByte > aes.BlockSize || lastByte%4 != 0 {
-		return payload, nil
+	// All the PKCS#7 padding bytes hold the length of the padding.
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return fmt.Errorf("%w: invalid PKCS#7 padding length %d", ErrDecryptionFailed, padding)
 	}
 
-	// As per PKCS#7 specification the last byte value will contain the number of bytes
-	// that were added as padding and all these extra bytes will have the same value as the
-	// last byte.
-	for _, paddingByte := range payload[payloadSize-lastByte:] {
-		if paddingByte != byte(lastByte) {
-			return payload, nil
+	for _, paddingByte := range decrypted[len(decrypted)-padding:] {
+		if paddingByte != byte(padding) {
+			return fmt.Errorf("%w: invalid PKCS#7 padding", ErrDecryptionFailed)
 		}
 	}
 
-	return payload[:payloadSize-lastByte], nil
+	c.decrypted = decrypted[:len(decrypted)-padding]
+
+	return nil
 }
@@ -0,0 +1,343 @@
+package restream
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+var (
+	testKey = []byte("0123456789abcdef")
+	testIV  = []byte("fedcba9876543210")
+)
+
+// encrypt pads plaintext with PKCS#7 and encrypts it with AES-128-CBC.
+func encrypt(t *testing.T, key, iv, plaintext []byte) []byte {
+	t.Helper()
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte(nil), plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	return encryptBlocks(t, key, iv, padded)
+}
+
+func encryptBlocks(t *testing.T, key, iv, data []byte) []byte {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, data)
+
+	return encrypted
+}
+
+func newTestCipher(t *testing.T, key, iv []byte) *aes128 {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &aes128{block: block, ivBytes: iv}
+}
+
+// chunkReader returns at most size bytes on every read.
+type chunkReader struct {
+	reader io.Reader
+	size   int
+}
+
+func (c chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.size {
+		p = p[:c.size]
+	}
+
+	return c.reader.Read(p)
+}
+
+// readAll reads reader using reads of at most size bytes.
+func readAll(reader io.Reader, size int) ([]byte, error) {
+	var output []byte
+	buffer := make([]byte, size)
+	for {
+		n, err := reader.Read(buffer)
+		output = append(output, buffer[:n]...)
+		if errors.Is(err, io.EOF) {
+			return output, nil
+		}
+		if err != nil {
+			return output, err
+		}
+	}
+}
+
+func TestCBCReaderPadding(t *testing.T) {
+	sourceSizes := []int{1, 7, 15, 16, 17, 31, 32, 33, decrypterBuffer}
+	readSizes := []int{1, 15, 16, 17, 4096}
+
+	for padding := 1; padding <= aes.BlockSize; padding++ {
+		plaintext := make([]byte, 3*aes.BlockSize-padding)
+		for i := range plaintext {
+			plaintext[i] = byte(i)
+		}
+		encrypted := encrypt(t, testKey, testIV, plaintext)
+
+		for _, sourceSize := range sourceSizes {
+			for _, readSize := range readSizes {
+				t.Run(fmt.Sprintf("padding %d source %d read %d", padding, sourceSize, readSize), func(t *testing.T) {
+					source := chunkReader{reader: bytes.NewReader(encrypted), size: sourceSize}
+					decrypted, err := readAll(newTestCipher(t, testKey, testIV).reader(source), readSize)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(decrypted, plaintext) {
+						t.Fatalf("got %x, want %x", decrypted, plaintext)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestCBCReaderOneByteSource(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("restreamer"), 1000)
+	encrypted := encrypt(t, testKey, testIV, plaintext)
+
+	reader := newTestCipher(t, testKey, testIV).reader(iotest.OneByteReader(bytes.NewReader(encrypted)))
+	decrypted, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("decrypted payload does not match the plaintext")
+	}
+}
+
+func TestCBCReaderEmpty(t *testing.T) {
+	decrypted, err := io.ReadAll(newTestCipher(t, testKey, testIV).reader(bytes.NewReader(nil)))
+	if err != nil || len(decrypted) != 0 {
+		t.Fatalf("got %x, %v", decrypted, err)
+	}
+}
+
+func TestCBCReaderInvalidPadding(t *testing.T) {
+	block := bytes.Repeat([]byte{0xaa}, aes.BlockSize)
+	withLastBytes := func(last ...byte) []byte {
+		data := append(append([]byte(nil), block...), block...)
+		copy(data[len(data)-len(last):], last)
+		return encryptBlocks(t, testKey, testIV, data)
+	}
+
+	tests := []struct {
+		name      string
+		encrypted []byte
+	}{
+		{name: "zero padding", encrypted: withLastBytes(0)},
+		{name: "padding longer than a block", encrypted: withLastBytes(aes.BlockSize + 1)},
+		{name: "inconsistent padding", encrypted: withLastBytes(1, 3, 3)},
+		{name: "partial block", encrypted: encrypt(t, testKey, testIV, block)[:aes.BlockSize+5]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := io.ReadAll(newTestCipher(t, testKey, testIV).reader(bytes.NewReader(test.encrypted)))
+			if !errors.Is(err, ErrDecryptionFailed) {
+				t.Fatalf("got %v, want %v", err, ErrDecryptionFailed)
+			}
+		})
+	}
+}
+
+func TestInitializationVector(t *testing.T) {
+	tests := []struct {
+		name          string
+		iv            string
+		mediaSequence uint64
+		want          string
+		wantErr       bool
+	}{
+		{name: "explicit", iv: "0x000102030405060708090A0B0C0D0E0F", mediaSequence: 9, want: "000102030405060708090a0b0c0d0e0f"},
+		{name: "explicit short", iv: "0x1F", want: "0000000000000000000000000000001f"},
+		{name: "sequence zero", want: "00000000000000000000000000000000"},
+		{name: "sequence", mediaSequence: 5, want: "00000000000000000000000000000005"},
+		{name: "large sequence", mediaSequence: 0x0102030405060708, want: "00000000000000000102030405060708"},
+		{name: "too long", iv: "0x000102030405060708090a0b0c0d0e0f10", wantErr: true},
+		{name: "not hex", iv: "0xzz", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			aesCipher := aes128{iv: test.iv, mediaSequence: test.mediaSequence}
+			iv, err := aesCipher.initializationVector()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %x", iv)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%x", iv); got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// TestDecryptKnownAnswer decrypts the CBC-AES128 vectors of NIST SP 800-38A, followed by a
+// block of padding, with an explicit IV.
+func TestDecryptKnownAnswer(t *testing.T) {
+	key := mustDecodeHex(t, "2b7e151628aed2a6abf7158809cf4f3c")
+	iv := mustDecodeHex(t, "000102030405060708090a0b0c0d0e0f")
+	plaintext := mustDecodeHex(t, "6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51"+
+		"30c81c46a35ce411e5fbc1191a0a52eff69f2445df4f9b17ad2b417be66c3710")
+	ciphertext := mustDecodeHex(t, "7649abac8119b246cee98e9b12e9197d5086cb9b507219ee95db113a917678b2"+
+		"73bed6b8e3c1743b7116e69e222295163ff1caa1681fac09120eca307586e1a7")
+
+	if encrypted := encrypt(t, key, iv, plaintext); !bytes.Equal(encrypted[:len(ciphertext)], ciphertext) {
+		t.Fatalf("got ciphertext %x, want %x", encrypted[:len(ciphertext)], ciphertext)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aesCipher := aes128{iv: "0x000102030405060708090a0b0c0d0e0f", mediaSequence: 1, block: block}
+	if aesCipher.ivBytes, err = aesCipher.initializationVector(); err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := io.ReadAll(aesCipher.reader(bytes.NewReader(encrypt(t, key, iv, plaintext))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("got %x, want %x", decrypted, plaintext)
+	}
+}
+
+func mustDecodeHex(t *testing.T, value string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// TestDecryptSegments restreams a playlist whose first segment has an explicit IV while the
+// IV of the segments after it is derived from their media sequence, the key of the second
+// segment being carried over to the third.
+func TestDecryptSegments(t *testing.T) {
+	segments := [][]byte{
+		bytes.Repeat([]byte("first segment "), 100),
+		bytes.Repeat([]byte("second segment "), 100),
+		bytes.Repeat([]byte("third segment "), 100),
+	}
+	ivs := [][]byte{
+		mustDecodeHex(t, "000102030405060708090a0b0c0d0e0f"),
+		mustDecodeHex(t, "00000000000000000000000000000008"),
+		mustDecodeHex(t, "00000000000000000000000000000009"),
+	}
+
+	files := map[string][]byte{
+		"/key.bin": testKey,
+		"/media.m3u8": []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:7\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\",IV=0x000102030405060708090a0b0c0d0e0f\n" +
+			"#EXTINF:2.0,\n0.ts\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n" +
+			"#EXTINF:2.0,\n1.ts\n" +
+			"#EXTINF:2.0,\n2.ts\n" +
+			"#EXT-X-ENDLIST\n"),
+	}
+	var want []byte
+	for i, segment := range segments {
+		files[fmt.Sprintf("/%d.ts", i)] = encrypt(t, testKey, ivs[i], segment)
+		want = append(want, segment...)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		data, ok := files[request.URL.Path]
+		if !ok {
+			http.NotFound(writer, request)
+			return
+		}
+		writer.Write(data)
+	}))
+	defer server.Close()
+
+	var output bytes.Buffer
+	restreamer := Restream{Writer: &output, KeyCache: NewKeyCache(time.Minute)}
+	if err := restreamer.Start(context.Background(), server.URL+"/media.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), want) {
+		t.Fatalf("got %q, want %q", output.Bytes(), want)
+	}
+}
+
+func TestKeyURL(t *testing.T) {
+	restreamer := Restream{KeyOverrides: map[string]string{
+		"https://example.com/hex":  "0x30313233343536373839616263646566",
+		"https://example.com/url":  "https://example.com/other",
+		"https://example.com/file": "file:///etc/restreamer/key.bin",
+	}}
+	if err := restreamer.initKeyOverrides(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		uri     string
+		want    string
+		wantErr bool
+	}{
+		{uri: "https://example.com/key", want: "https://example.com/key"},
+		{uri: "https://example.com/hex", want: "data:;base64,MDEyMzQ1Njc4OWFiY2RlZg=="},
+		{uri: "https://example.com/url", want: "https://example.com/other"},
+		{uri: "https://example.com/file", want: "file:///etc/restreamer/key.bin"},
+		{uri: "file:///etc/passwd", wantErr: true},
+		{uri: "FILE:///etc/passwd", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.uri, func(t *testing.T) {
+			keyURL, err := restreamer.keyURL(test.uri)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", keyURL)
+				}
+				return
+			}
+			if err != nil || keyURL != test.want {
+				t.Fatalf("got %s, %v, want %s", keyURL, err, test.want)
+			}
+		})
+	}
+}
+
+func TestInvalidKeyOverride(t *testing.T) {
+	for _, override := range []string{"0x0011", "00112233445566778899aabbccddeeff00", "not a key"} {
+		restreamer := Restream{KeyOverrides: map[string]string{"https://example.com/key": override}}
+		if err := restreamer.initKeyOverrides(); err == nil {
+			t.Errorf("expected an error for key override %s", override)
+		}
+	}
+}
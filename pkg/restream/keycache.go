@@ -0,0 +1,163 @@
+package restream
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/request"
+)
+
+const defaultKeyCacheTTL = 10 * time.Minute
+
+// Restream instances without a KeyCache share this cache.
+var defaultKeyCache = NewKeyCache(defaultKeyCacheTTL)
+
+// KeyCache holds the keys used to decrypt segments by key URL, so that each key is fetched
+// once. It is safe for concurrent use and can be shared by multiple Restream instances.
+type KeyCache struct {
+	ttl      time.Duration
+	mutex    sync.Mutex
+	keys     map[string]cachedKey
+	fetching map[string]*keyFetch
+}
+
+type cachedKey struct {
+	key     []byte
+	expires time.Time
+}
+
+// keyFetch is a key being fetched, done is closed once key or err is set.
+type keyFetch struct {
+	done chan struct{}
+	key  []byte
+	err  error
+}
+
+// NewKeyCache returns a cache keeping keys for ttl after they are fetched.
+func NewKeyCache(ttl time.Duration) *KeyCache {
+	return &KeyCache{
+		ttl:      ttl,
+		keys:     make(map[string]cachedKey),
+		fetching: make(map[string]*keyFetch),
+	}
+}
+
+// Invalidate removes the key fetched from keyURL so that it is fetched again when needed.
+func (k *KeyCache) Invalidate(keyURL string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	delete(k.keys, keyURL)
+}
+
+// get returns the key of keyURL, fetching it if it is not cached. Concurrent calls for a
+// key being fetched wait for that fetch.
+func (k *KeyCache) get(ctx context.Context, request request.Request, keyURL string) ([]byte, error) {
+	k.mutex.Lock()
+	if cached, ok := k.keys[keyURL]; ok && time.Now().Before(cached.expires) {
+		k.mutex.Unlock()
+		return cached.key, nil
+	}
+
+	fetch, ok := k.fetching[keyURL]
+	if ok {
+		k.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("key request aborted as context cancelled: %w", ctx.Err())
+		case <-fetch.done:
+			return fetch.key, fetch.err
+		}
+	}
+
+	fetch = &keyFetch{done: make(chan struct{})}
+	k.fetching[keyURL] = fetch
+	k.mutex.Unlock()
+
+	fetch.key, fetch.err = fetchKey(ctx, request, keyURL)
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	delete(k.fetching, keyURL)
+	close(fetch.done)
+	if fetch.err != nil {
+		return nil, fetch.err
+	}
+
+	now := time.Now()
+	for url, cached := range k.keys {
+		if now.After(cached.expires) {
+			delete(k.keys, url)
+		}
+	}
+	k.keys[keyURL] = cachedKey{key: fetch.key, expires: now.Add(k.ttl)}
+
+	return fetch.key, nil
+}
+
+// fetchKey gets the key from an HTTP(S) URL, a file:// URL or a data URI.
+func fetchKey(ctx context.Context, request request.Request, keyURL string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(keyURL, "data:"):
+		return decodeDataURI(keyURL)
+	case strings.HasPrefix(keyURL, "file:"):
+		parsedURL, err := url.Parse(keyURL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse key URL %s: %w", keyURL, err)
+		}
+
+		key, err := os.ReadFile(parsedURL.Path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key from %s: %w", keyURL, err)
+		}
+
+		return key, nil
+	}
+
+	keyFileResponse, err := request.Do(ctx, keyURL)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer keyFileResponse.Body.Close()
+
+	key, err := io.ReadAll(keyFileResponse.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key from %s: %w", keyURL, err)
+	}
+
+	return key, nil
+}
+
+// decodeDataURI returns the data of a data URI as defined in https://tools.ietf.org/html/rfc2397
+func decodeDataURI(uri string) ([]byte, error) {
+	separator := strings.Index(uri, ",")
+	if separator == -1 {
+		return nil, fmt.Errorf("invalid data URI")
+	}
+
+	data := uri[separator+1:]
+	if strings.HasSuffix(uri[:separator], ";base64") {
+		key, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode base64 data URI: %w", err)
+		}
+
+		return key, nil
+	}
+
+	key, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode data URI: %w", err)
+	}
+
+	return []byte(key), nil
+}
@@ -0,0 +1,86 @@
+package restream
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/request"
+)
+
+func newKeyServer(t *testing.T, fetches *int32, status *int32) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(fetches, 1)
+		time.Sleep(50 * time.Millisecond)
+
+		if code := atomic.LoadInt32(status); code != http.StatusOK {
+			writer.WriteHeader(int(code))
+			return
+		}
+		writer.Write(testKey)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestKeyCacheConcurrentFetch(t *testing.T) {
+	var fetches int32
+	status := int32(http.StatusOK)
+	server := newKeyServer(t, &fetches, &status)
+
+	keys := NewKeyCache(time.Minute)
+	keyRequest := request.New("test")
+
+	var wait sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+
+			key, err := keys.get(context.Background(), keyRequest, server.URL+"/key")
+			if err != nil || !bytes.Equal(key, testKey) {
+				t.Errorf("got %x, %v", key, err)
+			}
+		}()
+	}
+	wait.Wait()
+
+	if atomic.LoadInt32(&fetches) != 1 {
+		t.Fatalf("key fetched %d times, want 1", fetches)
+	}
+
+	keys.Invalidate(server.URL + "/key")
+	if _, err := keys.get(context.Background(), keyRequest, server.URL+"/key"); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&fetches) != 2 {
+		t.Fatalf("key fetched %d times after invalidation, want 2", fetches)
+	}
+}
+
+func TestKeyCacheFailedFetch(t *testing.T) {
+	var fetches int32
+	status := int32(http.StatusUnauthorized)
+	server := newKeyServer(t, &fetches, &status)
+
+	keys := NewKeyCache(time.Minute)
+	keyRequest := request.New("test")
+
+	if _, err := keys.get(context.Background(), keyRequest, server.URL+"/key"); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	key, err := keys.get(context.Background(), keyRequest, server.URL+"/key")
+	if err != nil || !bytes.Equal(key, testKey) {
+		t.Fatalf("got %x, %v", key, err)
+	}
+}
@@ -2,34 +2,90 @@ package restream
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+	"time"
 
+	"github.com/shaunschembri/restreamer/pkg/restream/normalize"
 	"github.com/shaunschembri/restreamer/pkg/restream/provider"
+	"github.com/shaunschembri/restreamer/pkg/restream/remux"
+	"github.com/shaunschembri/restreamer/pkg/restream/request"
 )
 
 const (
 	defaultUserAgent      = "restreamer"
 	defaultBandwidth      = 10485760
 	defaultReadBufferSize = 1048576
+	defaultConcurrency    = 1
 	mbDivider             = 1048576
 )
 
+// Restream streams an HLS stream to Writer. Each segment download reads from its
+// connection ReadBufferSize bytes at a time, and Concurrency segments are downloaded at the
+// same time, those ahead of the segment being written being held in memory up to 64MB each.
 type Restream struct {
-	UserAgent        string
-	MaxBandwidth     uint32
-	Writer           io.Writer
-	SegmentProvider  provider.Provider
-	ReadBufferSize   int
-	streamedBytes    int64
-	currentBandwidth uint32
-	segments         chan provider.Segment
-	errors           chan error
-	decrypter        decrypter
+	// streamedBytes is first to be 64-bit aligned for atomic access on 32-bit platforms.
+	streamedBytes     int64
+	UserAgent         string
+	RequestOptions    []request.Option
+	HTTPClient        *http.Client
+	MaxBandwidth      uint32
+	Variant           provider.VariantPreference
+	Writer            io.Writer
+	AudioWriter       io.Writer
+	SubtitleWriter    io.Writer
+	Remux             bool
+	Normalize         bool
+	SegmentProvider   provider.Provider
+	ReadBufferSize    int
+	Concurrency       int
+	KeyCache          *KeyCache
+	KeyOverrides      map[string]string
+	MaxLiveDuration   time.Duration
+	Observer          Observer
+	currentBandwidth  uint32
+	activeDownloads   int32
+	request           request.Request
+	segments          chan provider.Segment
+	errors            chan error
+	drained           chan struct{}
+	decrypter         decrypter
+	currentMaps       map[provider.Track]*provider.Map
+	sampleAESCounters map[provider.Track]map[uint16]*uint8
+	remuxer           *remux.Remuxer
+	normalizer        *normalize.Normalizer
+	currentKey        KeyEvent
+	keyOverrides      map[string]string
+	statsMutex        sync.Mutex
+	decrypterInfo     string
+	readBuffers       sync.Pool
+	startTime         time.Time
+	currentVariant    *provider.Variant
+	segmentsFetched   int64
+	segmentsFailed    int64
+	segmentRetries    int64
+	live              bool
+	segmentRequest    request.Request
+	pendingDuration   float64
+	mainWriter        io.Writer
+	audioWriter       io.Writer
+	subtitleWriter    io.Writer
 }
 
 func (r *Restream) init(ctx context.Context, playlistURL string) error {
+	if r.Observer == nil {
+		r.Observer = NopObserver{}
+	}
+
 	r.segments = make(chan provider.Segment, 1024)
 	r.errors = make(chan error, 1024)
+	r.drained = make(chan struct{})
+	r.currentMaps = make(map[provider.Track]*provider.Map)
+	r.sampleAESCounters = make(map[provider.Track]map[uint16]*uint8)
 
 	if r.MaxBandwidth == 0 {
 		r.MaxBandwidth = defaultBandwidth
@@ -39,13 +95,75 @@ func (r *Restream) init(ctx context.Context, playlistURL string) error {
 	if r.ReadBufferSize == 0 {
 		r.ReadBufferSize = defaultReadBufferSize
 	}
+	r.readBuffers.New = func() interface{} {
+		buffer := make([]byte, r.ReadBufferSize)
+		return &buffer
+	}
+
+	// The output is normalized after remuxing, so that the tracks are interleaved by their
+	// original timestamps.
+	output := r.Writer
+	if r.Normalize && r.Writer != nil {
+		r.normalizer = normalize.New(r.Writer)
+		output = r.normalizer
+	}
+
+	// Alternate renditions without a writer of their own are remuxed in the output.
+	r.mainWriter, r.audioWriter, r.subtitleWriter = output, r.AudioWriter, r.SubtitleWriter
+	if r.Remux && output != nil {
+		r.remuxer = remux.New(output)
+		r.mainWriter = r.remuxer.Video()
+		if r.audioWriter == nil {
+			r.audioWriter = r.remuxer.Audio()
+		}
+		if r.subtitleWriter == nil {
+			r.subtitleWriter = r.remuxer.Subtitles()
+		}
+	}
+
+	if r.Concurrency <= 0 {
+		r.Concurrency = defaultConcurrency
+	}
 
 	if r.UserAgent == "" {
 		r.UserAgent = defaultUserAgent
 	}
 
+	if r.KeyCache == nil {
+		r.KeyCache = defaultKeyCache
+	}
+
+	if err := r.initKeyOverrides(); err != nil {
+		return err
+	}
+
+	if r.HTTPClient == nil {
+		r.HTTPClient = request.NewClient()
+	}
+
+	cookieJar, err := cookiejar.New(nil)
+	if err != nil {
+		return fmt.Errorf("cannot create cookie jar: %w", err)
+	}
+
+	// Credentials are sent to the host of the playlist only, unless RequestOptions add
+	// more hosts. RequestOptions are applied last so they can override the defaults.
+	options := []request.Option{
+		request.WithClient(r.HTTPClient),
+		request.WithCookieJar(cookieJar),
+		request.WithOnRetry(r.Observer.Retried),
+	}
+	if parsedURL, err := url.Parse(playlistURL); err == nil && parsedURL.Host != "" {
+		options = append(options, request.WithAuthHosts(parsedURL.Host))
+	}
+	r.request = request.New(r.UserAgent, append(options, r.RequestOptions...)...)
+
+	// Retried segment downloads are counted in the stats.
+	segmentOptions := append(append([]request.Option(nil), options...), request.WithOnRetry(r.segmentRetried))
+	r.segmentRequest = request.New(r.UserAgent, append(segmentOptions, r.RequestOptions...)...)
+
 	if r.SegmentProvider == nil {
-		segmentProvider, err := r.detectStream(ctx, playlistURL, r.UserAgent, r.MaxBandwidth)
+		segmentProvider, err := r.detectStream(ctx, playlistURL, r.MaxBandwidth)
 		if err != nil {
 			return err
 		}
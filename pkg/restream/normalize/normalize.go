@@ -0,0 +1,314 @@
+// Package normalize rewrites concatenated MPEG-TS segments to play as one continuous stream.
+package normalize
+
+import (
+	"io"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/ts"
+)
+
+const (
+	timestampMask  = 1<<33 - 1
+	clockFrequency = 90000
+	pcrMultiplier  = 300
+	maxJump        = 10 * clockFrequency
+	timelineGap    = clockFrequency / 10
+	// maxHeldPackets limits the packets held back waiting for the PMT of a segment.
+	maxHeldPackets = 4096
+)
+
+// Normalizer fixes the continuity counters, shifts PCR, PTS and DTS to keep increasing
+// across timestamp jumps and bumps the PAT and PMT version when their content changes.
+// The packets of a segment are held back until its PMT, so that a PMT that changes is
+// written, preceded by the PAT, at the start of the segment even when the segment carries
+// it after other packets. Streams not starting with an MPEG-TS packet are written as they
+// are.
+type Normalizer struct {
+	output      io.Writer
+	partial     []byte
+	detected    bool
+	passthrough bool
+
+	pmtPIDs  map[uint16]bool
+	pcrPIDs  map[uint16]bool
+	counters map[uint16]uint8
+	sections map[uint16]*section
+	pat      []byte
+	holding  bool
+	held     [][]byte
+
+	lastInput     map[uint16]uint64
+	previous      uint64
+	hasPrevious   bool
+	offset        uint64
+	lastOutput    uint64
+	hasOutput     bool
+	discontinuity bool
+}
+
+// section is the last PSI section of a PID without version and CRC.
+type section struct {
+	content []byte
+	version uint8
+}
+
+// New returns a Normalizer writing the normalized stream to output.
+func New(output io.Writer) *Normalizer {
+	return &Normalizer{
+		output:    output,
+		holding:   true,
+		pmtPIDs:   make(map[uint16]bool),
+		pcrPIDs:   make(map[uint16]bool),
+		counters:  make(map[uint16]uint8),
+		sections:  make(map[uint16]*section),
+		lastInput: make(map[uint16]uint64),
+	}
+}
+
+// Discontinuity starts a new timeline even if the timestamps do not jump.
+func (n *Normalizer) Discontinuity() {
+	n.discontinuity = true
+}
+
+// EndSegment drops the incomplete packet at the end of a segment and writes the packets
+// held back when the segment has no PMT.
+func (n *Normalizer) EndSegment() error {
+	n.partial = nil
+
+	output := n.release(false, nil)
+	n.holding = true
+	if len(output) > 0 {
+		if _, err := n.output.Write(output); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (n *Normalizer) Write(p []byte) (int, error) {
+	if !n.detected && len(p) > 0 {
+		n.passthrough = p[0] != ts.SyncByte
+		n.detected = true
+	}
+	if n.passthrough {
+		return n.output.Write(p)
+	}
+
+	n.partial = append(n.partial, p...)
+	output := make([]byte, 0, len(n.partial))
+
+	for len(n.partial) >= ts.PacketSize {
+		if n.partial[0] != ts.SyncByte {
+			n.partial = n.partial[1:]
+			continue
+		}
+
+		packet := append([]byte(nil), n.partial[:ts.PacketSize]...)
+		n.partial = n.partial[ts.PacketSize:]
+
+		changed := false
+		if ts.PID(packet) != ts.NullPID {
+			changed = n.rewrite(packet)
+		}
+
+		if !n.holding {
+			output = n.emit(output, packet)
+			continue
+		}
+		n.held = append(n.held, packet)
+		if n.pmtPIDs[ts.PID(packet)] && ts.PayloadUnitStart(packet) || len(n.held) >= maxHeldPackets {
+			output = n.release(changed, output)
+		}
+	}
+
+	if len(output) > 0 {
+		if _, err := n.output.Write(output); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// emit appends packet to output with its continuity counter.
+func (n *Normalizer) emit(output, packet []byte) []byte {
+	n.updateCounter(packet)
+	if ts.PID(packet) == ts.PATPID && ts.PayloadUnitStart(packet) {
+		n.pat = packet
+	}
+
+	return append(output, packet...)
+}
+
+// release appends the packets held back to output. When the PMT ending them changed, it
+// is moved to the start of the segment after the PAT, the last one written if the segment
+// has none before it.
+func (n *Normalizer) release(changed bool, output []byte) []byte {
+	held := n.held
+	n.held = nil
+	n.holding = false
+
+	if changed {
+		pmt := held[len(held)-1]
+		held = held[:len(held)-1]
+
+		pat := n.pat
+		for i, packet := range held {
+			if ts.PID(packet) == ts.PATPID && ts.PayloadUnitStart(packet) {
+				pat = packet
+				held = append(held[:i:i], held[i+1:]...)
+				break
+			}
+		}
+		if pat != nil {
+			output = n.emit(output, append([]byte(nil), pat...))
+		}
+		output = n.emit(output, pmt)
+	}
+
+	for _, packet := range held {
+		output = n.emit(output, packet)
+	}
+
+	return output
+}
+
+// rewrite rewrites the timestamps and sections of packet, returning whether it carries a
+// PMT that changed.
+func (n *Normalizer) rewrite(packet []byte) bool {
+	pid := ts.PID(packet)
+
+	if field := ts.AdaptationField(packet); len(field) > 0 && field[0]&ts.AdaptationDiscontinuity != 0 {
+		field[0] &^= ts.AdaptationDiscontinuity
+		if n.pcrPIDs[pid] {
+			n.discontinuity = true
+		}
+	}
+
+	if pcr, ok := ts.PCR(packet); ok {
+		ts.SetPCR(packet, n.timestamp(pid, pcr/pcrMultiplier)*pcrMultiplier+pcr%pcrMultiplier)
+	}
+
+	if !ts.PayloadUnitStart(packet) {
+		return false
+	}
+
+	switch {
+	case pid == ts.PATPID:
+		n.rewriteSection(packet, n.readPAT)
+	case n.pmtPIDs[pid]:
+		return n.rewriteSection(packet, n.readPMT)
+	default:
+		pes, err := ts.ParsePES(ts.Payload(packet))
+		if err != nil {
+			return false
+		}
+
+		if dts, ok := pes.DTS(); ok {
+			pes.SetDTS(n.timestamp(pid, dts))
+		}
+		if pts, ok := pes.PTS(); ok {
+			pes.SetPTS(n.timestamp(pid, pts))
+		}
+	}
+
+	return false
+}
+
+func (n *Normalizer) updateCounter(packet []byte) {
+	pid := ts.PID(packet)
+	counter, ok := n.counters[pid]
+
+	switch {
+	case !ok:
+		counter = ts.ContinuityCounter(packet)
+	case ts.HasPayload(packet):
+		counter = (counter + 1) & 0x0f
+	}
+
+	n.counters[pid] = counter
+	ts.SetContinuityCounter(packet, counter)
+}
+
+// timestamp shifts the timestamps of a new timeline to continue after the last one written.
+func (n *Normalizer) timestamp(pid uint16, input uint64) uint64 {
+	last, ok := n.lastInput[pid]
+	if !ok {
+		last, ok = n.previous, n.hasPrevious
+	}
+	if ok && distance(last, input) > maxJump && distance(input, last) > maxJump {
+		n.discontinuity = true
+	}
+
+	if n.discontinuity {
+		n.discontinuity = false
+		n.lastInput = make(map[uint16]uint64)
+		if n.hasOutput {
+			n.offset = (n.lastOutput + timelineGap - input) & timestampMask
+		}
+	}
+	n.lastInput[pid] = input
+	n.previous, n.hasPrevious = input, true
+
+	output := (input + n.offset) & timestampMask
+	if !n.hasOutput || distance(n.lastOutput, output) < 1<<32 {
+		n.lastOutput = output
+		n.hasOutput = true
+	}
+
+	return output
+}
+
+func (n *Normalizer) readPAT(data []byte) {
+	pat, err := ts.ParsePAT(data)
+	if err != nil {
+		return
+	}
+
+	n.pmtPIDs = make(map[uint16]bool)
+	for _, pmtPID := range pat.Programs {
+		n.pmtPIDs[pmtPID] = true
+	}
+}
+
+func (n *Normalizer) readPMT(data []byte) {
+	if pmt, err := ts.ParsePMT(data); err == nil {
+		n.pcrPIDs[pmt.PCRPID] = true
+	}
+}
+
+// rewriteSection sets the version of a PSI section, returning whether its content is new.
+func (n *Normalizer) rewriteSection(packet []byte, read func(data []byte)) bool {
+	data, err := ts.Section(ts.Payload(packet))
+	if err != nil || len(data) < 8 {
+		return false
+	}
+	read(data)
+
+	content := append([]byte(nil), data[:len(data)-4]...)
+	content[5] &^= 0x3e
+
+	pid := ts.PID(packet)
+	last, ok := n.sections[pid]
+	changed := !ok || string(last.content) != string(content)
+	switch {
+	case !ok:
+		last = &section{content: content, version: data[5] >> 1 & 0x1f}
+		n.sections[pid] = last
+	case changed:
+		last.content = content
+		last.version = (last.version + 1) & 0x1f
+	}
+
+	data[5] = data[5]&^0x3e | last.version<<1
+	crc := ts.CRC32(data[:len(data)-4])
+	data[len(data)-4], data[len(data)-3], data[len(data)-2], data[len(data)-1] =
+		byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+
+	return changed
+}
+
+func distance(a, b uint64) uint64 {
+	return (b - a) & timestampMask
+}
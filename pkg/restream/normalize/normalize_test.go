@@ -0,0 +1,308 @@
+package normalize
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/ts"
+	"github.com/shaunschembri/restreamer/pkg/restream/ts/tstest"
+)
+
+// segment returns an MPEG-TS segment with a video and, unless audioType is 0, an audio PES
+// packet for every timestamp. The video packets carry the PCR and the continuity counters
+// start from 0 as in a segment of another encoder.
+func segment(audioType uint8, timestamps ...uint64) []byte {
+	stream := tstest.NewStream()
+	var streams []ts.PMTStream
+	if audioType != 0 {
+		streams = append(streams, ts.PMTStream{Type: audioType, PID: tstest.AudioPID})
+	}
+
+	stream.Tables(tstest.PMT(streams...))
+	for _, timestamp := range timestamps {
+		stream.PES(tstest.VideoPID, ts.NewPES(0xe0, timestamp, bytes.Repeat([]byte{0xaa}, 300)), tstest.PCRField(timestamp*300))
+		if audioType != 0 {
+			stream.PES(tstest.AudioPID, ts.NewPES(0xc0, timestamp, bytes.Repeat([]byte{0xbb}, 100)), nil)
+		}
+	}
+
+	return stream.Segment()
+}
+
+type packetInfo struct {
+	pid     uint16
+	counter uint8
+	pts     uint64
+	hasPTS  bool
+	pcr     uint64
+	hasPCR  bool
+	version uint8
+}
+
+func parse(t *testing.T, output []byte) []packetInfo {
+	t.Helper()
+
+	if len(output)%ts.PacketSize != 0 {
+		t.Fatalf("output size %d is not a multiple of %d", len(output), ts.PacketSize)
+	}
+
+	packets := make([]packetInfo, 0)
+	for ; len(output) > 0; output = output[ts.PacketSize:] {
+		packet := output[:ts.PacketSize]
+		info := packetInfo{pid: ts.PID(packet), counter: ts.ContinuityCounter(packet)}
+		info.pcr, info.hasPCR = ts.PCR(packet)
+
+		if ts.PayloadUnitStart(packet) {
+			switch info.pid {
+			case ts.PATPID, tstest.PMTPID:
+				section, err := ts.Section(ts.Payload(packet))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ts.CRC32(section) != 0 {
+					t.Fatalf("invalid CRC of section of PID %d", info.pid)
+				}
+				info.version = section[5] >> 1 & 0x1f
+			default:
+				pes, err := ts.ParsePES(ts.Payload(packet))
+				if err != nil {
+					t.Fatal(err)
+				}
+				info.pts, info.hasPTS = pes.PTS()
+			}
+		}
+
+		packets = append(packets, info)
+	}
+
+	return packets
+}
+
+func normalize(t *testing.T, write func(normalizer *Normalizer)) []packetInfo {
+	t.Helper()
+
+	var output bytes.Buffer
+	write(New(&output))
+
+	return parse(t, output.Bytes())
+}
+
+func writeSegment(t *testing.T, normalizer *Normalizer, data []byte) {
+	t.Helper()
+
+	if _, err := normalizer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := normalizer.EndSegment(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkContinuity checks that the continuity counters of every PID increase by one.
+func checkContinuity(t *testing.T, packets []packetInfo) {
+	t.Helper()
+
+	last := make(map[uint16]uint8)
+	for _, packet := range packets {
+		if counter, ok := last[packet.pid]; ok && packet.counter != (counter+1)&0x0f {
+			t.Fatalf("PID %d has continuity counter %d after %d", packet.pid, packet.counter, counter)
+		}
+		last[packet.pid] = packet.counter
+	}
+}
+
+// checkMonotonic checks that the PTS of every PID and the PCR increase.
+func checkMonotonic(t *testing.T, packets []packetInfo) {
+	t.Helper()
+
+	lastPTS := make(map[uint16]uint64)
+	var lastPCR uint64
+	for _, packet := range packets {
+		if packet.hasPTS {
+			if last, ok := lastPTS[packet.pid]; ok && packet.pts <= last {
+				t.Fatalf("PID %d has PTS %d after %d", packet.pid, packet.pts, last)
+			}
+			lastPTS[packet.pid] = packet.pts
+		}
+		if packet.hasPCR {
+			if packet.pcr <= lastPCR {
+				t.Fatalf("PCR %d after %d", packet.pcr, lastPCR)
+			}
+			lastPCR = packet.pcr
+		}
+	}
+}
+
+func TestNormalizerContinuity(t *testing.T) {
+	packets := normalize(t, func(normalizer *Normalizer) {
+		writeSegment(t, normalizer, segment(ts.StreamTypeADTS, 90000, 93000))
+		writeSegment(t, normalizer, segment(ts.StreamTypeADTS, 96000, 99000))
+	})
+
+	checkContinuity(t, packets)
+	checkMonotonic(t, packets)
+
+	// Timestamps that do not jump are kept as they are.
+	var pts []uint64
+	for _, packet := range packets {
+		if packet.hasPTS {
+			pts = append(pts, packet.pts)
+		}
+	}
+	if want := []uint64{90000, 90000, 93000, 93000, 96000, 96000, 99000, 99000}; !reflect.DeepEqual(pts, want) {
+		t.Fatalf("got PTS %v, want %v", pts, want)
+	}
+}
+
+func TestNormalizerTimestampJump(t *testing.T) {
+	tests := []struct {
+		name          string
+		second        []uint64
+		discontinuity bool
+	}{
+		{name: "forward", second: []uint64{90000000, 90003000}},
+		{name: "backward", second: []uint64{90000, 93000}},
+		{name: "wrap around", second: []uint64{timestampMask - 1000, 2000}},
+		{name: "discontinuity", second: []uint64{9000000, 9003000}, discontinuity: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packets := normalize(t, func(normalizer *Normalizer) {
+				writeSegment(t, normalizer, segment(ts.StreamTypeADTS, 9000000, 9003000))
+				if test.discontinuity {
+					normalizer.Discontinuity()
+				}
+				writeSegment(t, normalizer, segment(ts.StreamTypeADTS, test.second...))
+			})
+
+			checkContinuity(t, packets)
+			checkMonotonic(t, packets)
+
+			var pts []uint64
+			for _, packet := range packets {
+				if packet.hasPTS && packet.pid == tstest.VideoPID {
+					pts = append(pts, packet.pts)
+				}
+			}
+			want := []uint64{9000000, 9003000, 9003000 + timelineGap, 9003000 + timelineGap + distance(test.second[0], test.second[1])}
+			if !reflect.DeepEqual(pts, want) {
+				t.Fatalf("got PTS %v, want %v", pts, want)
+			}
+		})
+	}
+}
+
+func TestNormalizerSectionVersion(t *testing.T) {
+	packets := normalize(t, func(normalizer *Normalizer) {
+		writeSegment(t, normalizer, segment(ts.StreamTypeADTS, 90000))
+		writeSegment(t, normalizer, segment(ts.StreamTypeADTS, 93000))
+		writeSegment(t, normalizer, segment(ts.StreamTypeAC3, 96000))
+		writeSegment(t, normalizer, segment(0, 99000))
+	})
+
+	var patVersions, pmtVersions []uint8
+	for _, packet := range packets {
+		switch packet.pid {
+		case ts.PATPID:
+			patVersions = append(patVersions, packet.version)
+		case tstest.PMTPID:
+			pmtVersions = append(pmtVersions, packet.version)
+		}
+	}
+
+	if !reflect.DeepEqual(patVersions, []uint8{0, 0, 0, 0}) {
+		t.Fatalf("got PAT versions %v", patVersions)
+	}
+	if !reflect.DeepEqual(pmtVersions, []uint8{0, 0, 1, 2}) {
+		t.Fatalf("got PMT versions %v", pmtVersions)
+	}
+}
+
+func TestNormalizerPassthrough(t *testing.T) {
+	input := []byte{0x00, 0x00, 0x00, 0x08, 'f', 't', 'y', 'p', 0x47, 0x00}
+
+	var output bytes.Buffer
+	normalizer := New(&output)
+	if _, err := normalizer.Write(input); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), input) {
+		t.Fatal("fragmented MP4 was not written as it is")
+	}
+}
+
+func TestNormalizerLateSection(t *testing.T) {
+	pes := func(stream *tstest.Stream) {
+		stream.PES(tstest.VideoPID, ts.NewPES(0xe0, 93000, bytes.Repeat([]byte{0xaa}, 300)), tstest.PCRField(93000*300))
+		stream.PES(tstest.AudioPID, ts.NewPES(0xc0, 93000, bytes.Repeat([]byte{0xbb}, 100)), nil)
+	}
+
+	tests := []struct {
+		name string
+		// second builds a segment carrying its tables after its PES packets.
+		second      func(stream *tstest.Stream)
+		wantPIDs    []uint16
+		wantVersion uint8
+	}{
+		{
+			name: "PAT and changed PMT",
+			second: func(stream *tstest.Stream) {
+				pes(stream)
+				stream.Tables(tstest.PMT(ts.PMTStream{Type: ts.StreamTypeAC3, PID: tstest.AudioPID}))
+			},
+			wantPIDs:    []uint16{ts.PATPID, tstest.PMTPID, tstest.VideoPID, tstest.VideoPID, tstest.AudioPID},
+			wantVersion: 1,
+		},
+		{
+			name: "changed PMT only",
+			second: func(stream *tstest.Stream) {
+				pes(stream)
+				stream.Section(tstest.PMTPID, tstest.PMT(ts.PMTStream{Type: ts.StreamTypeAC3, PID: tstest.AudioPID}).Encode())
+			},
+			// The last PAT written precedes the PMT.
+			wantPIDs:    []uint16{ts.PATPID, tstest.PMTPID, tstest.VideoPID, tstest.VideoPID, tstest.AudioPID},
+			wantVersion: 1,
+		},
+		{
+			name: "unchanged PMT",
+			second: func(stream *tstest.Stream) {
+				pes(stream)
+				stream.Section(tstest.PMTPID, tstest.PMT(ts.PMTStream{Type: ts.StreamTypeADTS, PID: tstest.AudioPID}).Encode())
+			},
+			wantPIDs: []uint16{tstest.VideoPID, tstest.VideoPID, tstest.AudioPID, tstest.PMTPID},
+		},
+		{
+			name:     "no PMT",
+			second:   pes,
+			wantPIDs: []uint16{tstest.VideoPID, tstest.VideoPID, tstest.AudioPID},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first := segment(ts.StreamTypeADTS, 90000)
+			stream := tstest.NewStream()
+			test.second(stream)
+
+			packets := normalize(t, func(normalizer *Normalizer) {
+				writeSegment(t, normalizer, first)
+				writeSegment(t, normalizer, stream.Segment())
+			})
+			checkContinuity(t, packets)
+			checkMonotonic(t, packets)
+
+			var pids []uint16
+			for _, packet := range packets[len(first)/ts.PacketSize:] {
+				pids = append(pids, packet.pid)
+				if packet.pid == tstest.PMTPID && packet.version != test.wantVersion {
+					t.Fatalf("got PMT version %d, want %d", packet.version, test.wantVersion)
+				}
+			}
+			if !reflect.DeepEqual(pids, test.wantPIDs) {
+				t.Fatalf("got PIDs %v, want %v", pids, test.wantPIDs)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package restream
+
+import (
+	"time"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/provider"
+	"github.com/shaunschembri/restreamer/pkg/restream/request"
+)
+
+// Observer is notified of the events of a stream, for example to build a user interface or
+// to log them. Its methods are called synchronously, possibly from different goroutines at
+// the same time, so they should return quickly. Embed NopObserver to implement only some
+// of the methods.
+type Observer interface {
+	// PlaylistRefreshed is called after each refresh of the playlist with the new segments
+	// or with the error that stops the stream.
+	PlaylistRefreshed(event PlaylistEvent)
+	// VariantSwitched is called when a variant of a master playlist is selected, the
+	// first one included.
+	VariantSwitched(variant provider.Variant)
+	// KeyChanged is called before SegmentStarted of the first segment with another
+	// encryption method or key.
+	KeyChanged(event KeyEvent)
+	// SegmentStarted is called with each segment, in order, before it is written.
+	SegmentStarted(segment provider.Segment)
+	// SegmentFinished is called once a segment is written or fails.
+	SegmentFinished(event SegmentEvent)
+	// Retried is called whenever a failed request is retried.
+	Retried(retry request.Retry)
+	// Error is called with the error that stops the stream.
+	Error(err error)
+}
+
+type PlaylistEvent struct {
+	Segments []provider.Segment
+	Reload   time.Duration
+	Err      error
+}
+
+// KeyEvent describes the encryption of the segments, URL is empty for segments not
+// encrypted.
+type KeyEvent struct {
+	Method string
+	URL    string
+}
+
+// SegmentEvent describes a segment once written. Bytes is the size written to the output,
+// BytesDownloaded the size of the segment as downloaded and DownloadTime the time from
+// requesting the segment until it is fully downloaded. BytesDownloaded and DownloadTime
+// are only set for segments written successfully. Err is set when the segment fails,
+// possibly wrapping ErrDecryptionFailed.
+type SegmentEvent struct {
+	Segment         provider.Segment
+	Bytes           int64
+	BytesDownloaded int64
+	DownloadTime    time.Duration
+	Err             error
+}
+
+// NopObserver ignores all events.
+type NopObserver struct{}
+
+func (NopObserver) PlaylistRefreshed(PlaylistEvent)  {}
+func (NopObserver) VariantSwitched(provider.Variant) {}
+func (NopObserver) KeyChanged(KeyEvent)              {}
+func (NopObserver) SegmentStarted(provider.Segment)  {}
+func (NopObserver) SegmentFinished(SegmentEvent)     {}
+func (NopObserver) Retried(request.Retry)            {}
+func (NopObserver) Error(error)                      {}
@@ -0,0 +1,192 @@
+package restream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/provider"
+)
+
+type segmentRecorder struct {
+	NopObserver
+	mutex    sync.Mutex
+	started  []provider.Segment
+	finished []SegmentEvent
+}
+
+func (s *segmentRecorder) SegmentStarted(segment provider.Segment) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.started = append(s.started, segment)
+}
+
+func (s *segmentRecorder) SegmentFinished(event SegmentEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.finished = append(s.finished, event)
+}
+
+func TestSegmentStartedMetadata(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:5
+#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00Z
+#EXTINF:2.0,First
+segment.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:2.0,Second
+segment.ts
+#EXT-X-GAP
+#EXTINF:2.0,
+gap.ts
+#EXT-X-ENDLIST
+`
+
+	var gapRequests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/playlist.m3u8", func(writer http.ResponseWriter, request *http.Request) {
+		io.WriteString(writer, playlist)
+	})
+	mux.HandleFunc("/segment.ts", func(writer http.ResponseWriter, request *http.Request) {
+		io.WriteString(writer, "segment")
+	})
+	mux.HandleFunc("/gap.ts", func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&gapRequests, 1)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var output bytes.Buffer
+	recorder := &segmentRecorder{}
+	streamer := &Restream{Writer: &output, Observer: recorder}
+	if err := streamer.Start(context.Background(), server.URL+"/playlist.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	want := []provider.Segment{
+		{MediaSequence: 5, DiscontinuitySequence: 0, ProgramDateTime: start, Title: "First"},
+		{MediaSequence: 6, Discontinuity: true, DiscontinuitySequence: 1, ProgramDateTime: start.Add(2 * time.Second), Title: "Second"},
+		{MediaSequence: 7, DiscontinuitySequence: 1, ProgramDateTime: start.Add(4 * time.Second), Gap: true},
+	}
+
+	if len(recorder.started) != len(want) {
+		t.Fatalf("got %d started segments, want %d", len(recorder.started), len(want))
+	}
+	for i, segment := range recorder.started {
+		if segment.MediaSequence != want[i].MediaSequence || segment.Discontinuity != want[i].Discontinuity ||
+			segment.DiscontinuitySequence != want[i].DiscontinuitySequence || !segment.ProgramDateTime.Equal(want[i].ProgramDateTime) ||
+			segment.Title != want[i].Title || segment.Gap != want[i].Gap {
+			t.Errorf("segment %d is %+v, want %+v", i, segment, want[i])
+		}
+	}
+
+	if len(recorder.finished) != len(want) || recorder.finished[2].Err != nil {
+		t.Fatalf("got finished segments %+v", recorder.finished)
+	}
+	for i, event := range recorder.finished[:2] {
+		if event.BytesDownloaded != int64(len("segment")) {
+			t.Errorf("segment %d has %d bytes downloaded", i, event.BytesDownloaded)
+		}
+	}
+	if atomic.LoadInt32(&gapRequests) != 0 {
+		t.Fatal("gap segment was downloaded")
+	}
+	if output.String() != "segmentsegment" {
+		t.Fatalf("got output %q", output.String())
+	}
+}
+
+// eventRecorder records the key changes and started segments in the order they happen.
+type eventRecorder struct {
+	NopObserver
+	mutex  sync.Mutex
+	events []string
+}
+
+func (e *eventRecorder) KeyChanged(event KeyEvent) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	key := "key " + event.Method
+	if event.URL != "" {
+		key += " " + path.Base(event.URL)
+	}
+	e.events = append(e.events, key)
+}
+
+func (e *eventRecorder) SegmentStarted(segment provider.Segment) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.events = append(e.events, "segment "+path.Base(segment.URL))
+}
+
+func TestKeyChangedOrder(t *testing.T) {
+	otherKey := []byte("fedcba9876543210")
+	files := map[string][]byte{
+		"/key1.bin": testKey,
+		"/key2.bin": otherKey,
+		"/media.m3u8": []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"key1.bin\",IV=0x000102030405060708090a0b0c0d0e0f\n" +
+			"#EXTINF:2.0,\n1.ts\n#EXTINF:2.0,\n2.ts\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"key2.bin\",IV=0x000102030405060708090a0b0c0d0e0f\n" +
+			"#EXTINF:2.0,\n3.ts\n" +
+			"#EXT-X-KEY:METHOD=NONE\n" +
+			"#EXTINF:2.0,\n4.ts\n" +
+			"#EXT-X-ENDLIST\n"),
+		"/4.ts": []byte("4"),
+	}
+	iv := mustDecodeHex(t, "000102030405060708090a0b0c0d0e0f")
+	files["/1.ts"] = encrypt(t, testKey, iv, []byte("1"))
+	files["/2.ts"] = encrypt(t, testKey, iv, []byte("2"))
+	files["/3.ts"] = encrypt(t, otherKey, iv, []byte("3"))
+
+	lastServed := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/1.ts":
+			// All the segments are queued before the first one is written.
+			select {
+			case <-lastServed:
+			case <-time.After(5 * time.Second):
+				t.Error("last segment not downloaded at the same time as the first")
+			}
+		case "/4.ts":
+			defer close(lastServed)
+		}
+		writer.Write(files[request.URL.Path])
+	}))
+	defer server.Close()
+
+	var output bytes.Buffer
+	recorder := &eventRecorder{}
+	streamer := &Restream{Writer: &output, Observer: recorder, Concurrency: 4, KeyCache: NewKeyCache(time.Minute)}
+	if err := streamer.Start(context.Background(), server.URL+"/media.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"key AES-128 key1.bin", "segment 1.ts", "segment 2.ts",
+		"key AES-128 key2.bin", "segment 3.ts",
+		"key NONE", "segment 4.ts",
+	}
+	if !reflect.DeepEqual(recorder.events, want) {
+		t.Fatalf("got events %q, want %q", recorder.events, want)
+	}
+	if output.String() != "1234" {
+		t.Fatalf("got output %q", output.String())
+	}
+}
@@ -3,6 +3,8 @@ package hls
 import (
 	"context"
 	"fmt"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/grafov/m3u8"
@@ -13,15 +15,24 @@ import (
 
 type Master struct {
 	media            *Media
+	audio            *Media
+	subtitles        *Media
 	playlist         *Playlist
+	preference       provider.VariantPreference
 	resolution       string
+	audioName        string
+	subtitlesName    string
 	maxBandwidth     uint32
 	variantBandwidth uint32
+	renditions       map[provider.Track]bool
+	failed           map[provider.Track]bool
 }
 
 func NewMaster(request request.Request, maxBandwidth uint32) *Master {
 	return &Master{
 		media:        NewMedia(request),
+		audio:        NewMedia(request).WithTrack(provider.TrackAudio),
+		subtitles:    NewMedia(request).WithTrack(provider.TrackSubtitles),
 		maxBandwidth: maxBandwidth,
 	}
 }
@@ -31,39 +42,180 @@ func (m Master) WithPlaylist(playlist *Playlist) *Master {
 	return &m
 }
 
+func (m Master) WithPreference(preference provider.VariantPreference) *Master {
+	m.preference = preference
+	return &m
+}
+
+// WithRenditions restricts the alternate renditions fetched to those of tracks. All the
+// selected renditions are fetched unless it is called.
+func (m Master) WithRenditions(tracks ...provider.Track) *Master {
+	m.renditions = make(map[provider.Track]bool)
+	for _, track := range tracks {
+		m.renditions[track] = true
+	}
+	return &m
+}
+
 func (m Master) Info() string {
 	infoStr := fmt.Sprintf("Master | Bandwidth: %3.1fMb/s", float32(m.variantBandwidth)/mbDivider)
 	if m.resolution != "" {
 		infoStr += fmt.Sprintf(" | Resolution: %s", m.resolution)
 	}
+	if m.audioName != "" {
+		infoStr += fmt.Sprintf(" | Audio: %s", m.audioName)
+	}
+	if m.subtitlesName != "" {
+		infoStr += fmt.Sprintf(" | Subtitles: %s", m.subtitlesName)
+	}
 
 	return infoStr
 }
 
+func (m Master) Variant() provider.Variant {
+	return provider.Variant{
+		URL:        m.media.playlistURL,
+		Bandwidth:  m.variantBandwidth,
+		Resolution: m.resolution,
+		Audio:      m.audioName,
+		Subtitles:  m.subtitlesName,
+	}
+}
+
+func (m Master) EndOfStream() bool {
+	for _, media := range m.tracks() {
+		if !m.failed[media.track] && !media.EndOfStream() {
+			return false
+		}
+	}
+
+	return true
+}
+
+type trackSegments struct {
+	segments []provider.Segment
+	reload   time.Duration
+	err      error
+}
+
+// Get returns the segments of the selected variant together with the segments of the
+// selected audio and subtitles renditions. The media playlists are fetched in parallel.
+// Failing to fetch a rendition is not fatal, its segments being skipped until it is
+// fetched again.
 func (m *Master) Get(ctx context.Context, bandwidth uint32) ([]provider.Segment, time.Duration, error) {
 	if err := m.selectVariant(bandwidth); err != nil {
 		return nil, 0, err
 	}
 
-	return m.media.Get(ctx, bandwidth)
-}
+	tracks := m.tracks()
+	results := make([]trackSegments, len(tracks))
 
-func (m *Master) selectVariant(streamSpeed uint32) error {
-	var targetVariant *m3u8.Variant
-	minDiff := streamSpeed
+	var wg sync.WaitGroup
+	for i, media := range tracks {
+		wg.Add(1)
+		go func(i int, media *Media) {
+			defer wg.Done()
+			results[i].segments, results[i].reload, results[i].err = media.Get(ctx, bandwidth)
+		}(i, media)
+	}
+	wg.Wait()
 
-	for _, variant := range m.playlist.playlist.(*m3u8.MasterPlaylist).Variants {
-		if variant.Bandwidth > m.maxBandwidth || variant.Bandwidth > streamSpeed {
+	if results[0].err != nil {
+		return nil, 0, fmt.Errorf("cannot get %s playlist: %w", tracks[0].track, results[0].err)
+	}
+
+	m.failed = make(map[provider.Track]bool)
+	trackSegments := make([][]provider.Segment, 0, len(results))
+	var reloadPlaylistAfter time.Duration
+	for i, result := range results {
+		if result.err != nil {
+			log.Printf("Skipping %s rendition: cannot get playlist: %v", tracks[i].track, result.err)
+			m.failed[tracks[i].track] = true
 			continue
 		}
 
-		diff := streamSpeed - variant.Bandwidth
-		if diff >= minDiff && targetVariant != nil {
-			continue
+		trackSegments = append(trackSegments, result.segments)
+		if i == 0 || result.reload < reloadPlaylistAfter {
+			reloadPlaylistAfter = result.reload
+		}
+	}
+
+	return interleave(trackSegments), reloadPlaylistAfter, nil
+}
+
+// interleave merges the segments of the tracks by their start time, counted from the
+// first segment returned for each track, so that the segments of the renditions follow
+// the segment of the variant they play with and tracks are downloaded, and remuxed,
+// together. Media sequence numbers are not comparable across tracks.
+func interleave(tracks [][]provider.Segment) []provider.Segment {
+	segments := make([]provider.Segment, 0)
+	positions := make([]int, len(tracks))
+	starts := make([]float64, len(tracks))
+
+	for {
+		next := -1
+		for i, track := range tracks {
+			// Segments starting within a millisecond of each other keep the track order.
+			if positions[i] < len(track) && (next < 0 || starts[i] < starts[next]-0.001) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return segments
+		}
+
+		segment := tracks[next][positions[next]]
+		segments = append(segments, segment)
+		starts[next] += segment.Duration
+		positions[next]++
+	}
+}
+
+// Tracks returns the tracks of the segments returned by the last call to Get, which
+// excludes the renditions that failed.
+func (m Master) Tracks() []provider.Track {
+	tracks := make([]provider.Track, 0, 3)
+	for _, media := range m.tracks() {
+		if !m.failed[media.track] {
+			tracks = append(tracks, media.track)
 		}
+	}
+
+	return tracks
+}
+
+// tracks returns the media playlists of the selected variant and renditions.
+func (m Master) tracks() []*Media {
+	tracks := []*Media{m.media}
+	// Subtitles precede audio so that, when remuxed, cues are queued before the audio
+	// releases the video held back waiting for it.
+	for _, media := range []*Media{m.subtitles, m.audio} {
+		if media.playlistURL != "" && (m.renditions == nil || m.renditions[media.track]) {
+			tracks = append(tracks, media)
+		}
+	}
+
+	return tracks
+}
+
+func (m *Master) selectVariant(streamSpeed uint32) error {
+	variants := m.allowedVariants()
+	if len(variants) == 0 {
+		return fmt.Errorf("no variants found in master playlist")
+	}
 
-		minDiff = diff
-		targetVariant = variant
+	// Select the variant with the highest bandwidth that fits within the stream speed or
+	// the variant with the lowest bandwidth if none of them fit.
+	var targetVariant *m3u8.Variant
+	for _, variant := range variants {
+		switch {
+		case targetVariant == nil:
+			targetVariant = variant
+		case variant.Bandwidth <= streamSpeed && (variant.Bandwidth > targetVariant.Bandwidth || targetVariant.Bandwidth > streamSpeed):
+			targetVariant = variant
+		case targetVariant.Bandwidth > streamSpeed && variant.Bandwidth < targetVariant.Bandwidth:
+			targetVariant = variant
+		}
 	}
 
 	parsedURI, err := m.media.request.ResolveReference(targetVariant.URI, m.playlist.referenceURL)
@@ -75,5 +227,60 @@ func (m *Master) selectVariant(streamSpeed uint32) error {
 	m.resolution = targetVariant.Resolution
 	m.variantBandwidth = targetVariant.Bandwidth
 
+	audio := m.selectRendition("AUDIO", targetVariant.Audio, m.preference.Audio)
+	if m.audio, err = m.withRendition(m.audio, audio); err != nil {
+		return err
+	}
+	m.audioName = renditionName(audio)
+
+	var subtitles *m3u8.Alternative
+	if m.preference.Subtitles.Name != "" || len(m.preference.Subtitles.Languages) > 0 {
+		subtitles = m.selectRendition("SUBTITLES", targetVariant.Subtitles, m.preference.Subtitles)
+	}
+	if m.subtitles, err = m.withRendition(m.subtitles, subtitles); err != nil {
+		return err
+	}
+	m.subtitlesName = renditionName(subtitles)
+
 	return nil
 }
+
+// allowedVariants returns the variants within the max bandwidth and the variant preference.
+// If no variant satisfies them, all the variants are returned so that the stream can still
+// be played.
+func (m *Master) allowedVariants() []*m3u8.Variant {
+	all := make([]*m3u8.Variant, 0)
+	allowed := make([]*m3u8.Variant, 0)
+
+	for _, variant := range m.playlist.playlist.(*m3u8.MasterPlaylist).Variants {
+		if variant == nil || variant.Iframe {
+			continue
+		}
+		all = append(all, variant)
+
+		if variant.Bandwidth > m.maxBandwidth || variant.Bandwidth < m.preference.MinBandwidth {
+			continue
+		}
+
+		if m.preference.MaxHeight > 0 && resolutionHeight(variant.Resolution) > m.preference.MaxHeight {
+			continue
+		}
+
+		allowed = append(allowed, variant)
+	}
+
+	if len(allowed) == 0 {
+		return all
+	}
+
+	return allowed
+}
+
+func resolutionHeight(resolution string) int {
+	var width, height int
+	if _, err := fmt.Sscanf(resolution, "%dx%d", &width, &height); err != nil {
+		return 0
+	}
+
+	return height
+}
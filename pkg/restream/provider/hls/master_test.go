@@ -0,0 +1,47 @@
+package hls
+
+import (
+	"testing"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/provider"
+)
+
+func segmentsOf(track provider.Track, firstSequence uint64, durations ...float64) []provider.Segment {
+	segments := make([]provider.Segment, 0, len(durations))
+	for i, duration := range durations {
+		segments = append(segments, provider.Segment{Track: track, MediaSequence: firstSequence + uint64(i), Duration: duration})
+	}
+
+	return segments
+}
+
+func TestInterleave(t *testing.T) {
+	tracks := [][]provider.Segment{
+		segmentsOf(provider.TrackMain, 100, 6, 6, 6),
+		segmentsOf(provider.TrackSubtitles, 7, 6, 6, 6),
+		// Audio segments are shorter and numbered from another media sequence.
+		segmentsOf(provider.TrackAudio, 3, 4, 4, 4, 4, 2),
+	}
+
+	want := []struct {
+		track    provider.Track
+		sequence uint64
+	}{
+		{provider.TrackMain, 100}, {provider.TrackSubtitles, 7}, {provider.TrackAudio, 3},
+		{provider.TrackAudio, 4},
+		{provider.TrackMain, 101}, {provider.TrackSubtitles, 8},
+		{provider.TrackAudio, 5},
+		{provider.TrackMain, 102}, {provider.TrackSubtitles, 9}, {provider.TrackAudio, 6},
+		{provider.TrackAudio, 7},
+	}
+
+	segments := interleave(tracks)
+	if len(segments) != len(want) {
+		t.Fatalf("got %d segments, want %d", len(segments), len(want))
+	}
+	for i, segment := range segments {
+		if segment.Track != want[i].track || segment.MediaSequence != want[i].sequence {
+			t.Errorf("segment %d is %s %d, want %s %d", i, segment.Track, segment.MediaSequence, want[i].track, want[i].sequence)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package hls
 import (
 	"context"
 	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/grafov/m3u8"
@@ -15,8 +17,10 @@ const mbDivider = 1048576
 
 type Media struct {
 	request      request.Request
+	track        provider.Track
 	playlistURL  string
-	lastMediaSeq uint64
+	nextMediaSeq uint64
+	endOfStream  bool
 }
 
 func NewMedia(request request.Request) *Media {
@@ -30,10 +34,20 @@ func (m Media) WithPlaylistURL(playlistURL string) *Media {
 	return &m
 }
 
+// WithTrack sets the track of the segments returned.
+func (m Media) WithTrack(track provider.Track) *Media {
+	m.track = track
+	return &m
+}
+
 func (m Media) Info() string {
 	return "Media"
 }
 
+func (m Media) EndOfStream() bool {
+	return m.endOfStream
+}
+
 func (m *Media) Get(ctx context.Context, bandwidth uint32) ([]provider.Segment, time.Duration, error) {
 	playlist, err := GetPlaylist(ctx, m.request, m.playlistURL)
 	if err != nil {
@@ -48,35 +62,112 @@ func (m *Media) Get(ctx context.Context, bandwidth uint32) ([]provider.Segment,
 	newSegmentsFound := false
 	mediaSeq := mediaPlaylist.SeqNo
 	segments := make([]provider.Segment, 0)
+
+	// An EXT-X-KEY applies to all the segments that follow it until the next EXT-X-KEY
+	// but it is only linked to the first of these segments by the playlist decoder.
+	// The same applies to EXT-X-MAP.
+	var key *m3u8.Key
+	var segmentMap *provider.Map
+
+	// A byte range without an offset starts after the byte range of the previous segment
+	// when this is a sub-range of the same resource.
+	var previousURL string
+	var nextOffset int64
+
+	// EXT-X-PROGRAM-DATE-TIME applies to the segments that follow it, whose date and time
+	// is derived from the durations of the segments before them.
+	var programDateTime time.Time
+	discontinuitySeq := mediaPlaylist.DiscontinuitySeq
+
 	for _, mediaSegment := range mediaPlaylist.Segments {
 		if mediaSegment != nil {
-			if mediaSeq > m.lastMediaSeq {
-				newSegmentsFound = true
-				m.lastMediaSeq = mediaSeq
+			if mediaSegment.Key != nil {
+				key = mediaSegment.Key
+			}
+
+			if mediaSegment.Discontinuity {
+				discontinuitySeq++
+			}
+			if !mediaSegment.ProgramDateTime.IsZero() {
+				programDateTime = mediaSegment.ProgramDateTime
+			}
 
-				url, err := m.request.ResolveReference(mediaSegment.URI, playlist.referenceURL)
+			if mediaSegment.Map != nil {
+				mapURL, err := m.request.ResolveReference(mediaSegment.Map.URI, playlist.referenceURL)
 				if err != nil {
-					return nil, 0, fmt.Errorf("cannot resolve reference URL: %w", err)
+					return nil, 0, fmt.Errorf("cannot resolve map URI: %w", err)
+				}
+
+				segmentMap = &provider.Map{
+					URL: mapURL.String(),
+					ByteRange: provider.ByteRange{
+						Length: mediaSegment.Map.Limit,
+						Offset: mediaSegment.Map.Offset,
+					},
+				}
+			}
+
+			url, err := m.request.ResolveReference(mediaSegment.URI, playlist.referenceURL)
+			if err != nil {
+				return nil, 0, fmt.Errorf("cannot resolve reference URL: %w", err)
+			}
+
+			byteRange := provider.ByteRange{}
+			if mediaSegment.Limit > 0 {
+				byteRange.Length = mediaSegment.Limit
+				byteRange.Offset = mediaSegment.Offset
+				if !hasByteRangeOffset(mediaSegment) && url.String() == previousURL {
+					byteRange.Offset = nextOffset
 				}
 
+				previousURL = url.String()
+				nextOffset = byteRange.Offset + byteRange.Length
+			} else {
+				previousURL = ""
+			}
+
+			if mediaSeq >= m.nextMediaSeq {
+				newSegmentsFound = true
+				m.nextMediaSeq = mediaSeq + 1
+
 				segment := provider.Segment{
-					URL:       url.String(),
-					KeyMethod: "NONE",
-					Duration:  mediaSegment.Duration,
+					Track:         m.track,
+					URL:           url.String(),
+					ByteRange:     byteRange,
+					MediaSequence: mediaSeq,
+					KeyMethod:     "NONE",
+					Duration:      mediaSegment.Duration,
+					Map:           segmentMap,
+
+					Discontinuity:         mediaSegment.Discontinuity,
+					DiscontinuitySequence: discontinuitySeq,
+					ProgramDateTime:       programDateTime,
+					Title:                 mediaSegment.Title,
+					Gap:                   isGap(mediaSegment),
 				}
-				if mediaSegment.Key != nil {
-					segment.KeyMethod = mediaSegment.Key.Method
-					segment.KeyURL = mediaSegment.Key.URI
-					segment.IV = mediaSegment.Key.IV
+				if key != nil {
+					keyURL, err := m.resolveKeyURI(key.URI, playlist.referenceURL)
+					if err != nil {
+						return nil, 0, err
+					}
+
+					segment.KeyMethod = key.Method
+					segment.KeyURL = keyURL
+					segment.IV = key.IV
 				}
 
 				segments = append(segments, segment)
 			}
 
 			mediaSeq++
+			if !programDateTime.IsZero() {
+				programDateTime = programDateTime.Add(time.Duration(mediaSegment.Duration * float64(time.Second)))
+			}
 		}
 	}
 
+	m.endOfStream = mediaPlaylist.Closed
+
 	// Reload playlist according to https://tools.ietf.org/html/draft-pantos-http-live-streaming-19#section-6.3.4
 	reloadPlaylistAfter := time.Duration(mediaPlaylist.TargetDuration * float64(time.Second))
 	if !newSegmentsFound {
@@ -85,3 +176,18 @@ func (m *Media) Get(ctx context.Context, bandwidth uint32) ([]provider.Segment,
 
 	return segments, reloadPlaylistAfter, nil
 }
+
+// resolveKeyURI resolves relative key URIs against the playlist URL. Data URIs carry the
+// key inline and are returned as is.
+func (m *Media) resolveKeyURI(uri string, referenceURL *url.URL) (string, error) {
+	if uri == "" || strings.HasPrefix(uri, "data:") {
+		return uri, nil
+	}
+
+	keyURL, err := m.request.ResolveReference(uri, referenceURL)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve key URI: %w", err)
+	}
+
+	return keyURL.String(), nil
+}
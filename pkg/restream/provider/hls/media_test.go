@@ -0,0 +1,85 @@
+package hls
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/provider"
+	"github.com/shaunschembri/restreamer/pkg/restream/request"
+)
+
+// playlistServer serves playlists by path.
+func playlistServer(t *testing.T, playlists map[string]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		playlist, ok := playlists[request.URL.Path]
+		if !ok {
+			http.NotFound(writer, request)
+			return
+		}
+		io.WriteString(writer, playlist)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestMediaByteRange(t *testing.T) {
+	server := playlistServer(t, map[string]string{"/media.m3u8": `#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:2
+#EXTINF:2.0,
+#EXT-X-BYTERANGE:1000@200
+main.ts
+#EXTINF:2.0,
+#EXT-X-BYTERANGE:500
+main.ts
+#EXTINF:2.0,
+#EXT-X-BYTERANGE:300
+main.ts
+#EXTINF:2.0,
+#EXT-X-BYTERANGE:400@0
+other.ts
+#EXTINF:2.0,
+#EXT-X-BYTERANGE:100
+other.ts
+#EXTINF:2.0,
+whole.ts
+#EXTINF:2.0,
+#EXT-X-BYTERANGE:50@10
+main.ts
+#EXT-X-ENDLIST
+`})
+
+	media := NewMedia(request.New("test")).WithPlaylistURL(server.URL + "/media.m3u8")
+	segments, _, err := media.Get(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		path      string
+		byteRange provider.ByteRange
+	}{
+		{"/main.ts", provider.ByteRange{Offset: 200, Length: 1000}},
+		{"/main.ts", provider.ByteRange{Offset: 1200, Length: 500}},
+		{"/main.ts", provider.ByteRange{Offset: 1700, Length: 300}},
+		{"/other.ts", provider.ByteRange{Offset: 0, Length: 400}},
+		{"/other.ts", provider.ByteRange{Offset: 400, Length: 100}},
+		{"/whole.ts", provider.ByteRange{}},
+		{"/main.ts", provider.ByteRange{Offset: 10, Length: 50}},
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("got %d segments, want %d", len(segments), len(want))
+	}
+	for i, segment := range segments {
+		if segment.URL != server.URL+want[i].path || segment.ByteRange != want[i].byteRange {
+			t.Errorf("segment %d is %s %+v, want %s %+v", i, segment.URL, segment.ByteRange, want[i].path, want[i].byteRange)
+		}
+	}
+	if !media.EndOfStream() {
+		t.Fatal("end of stream not detected")
+	}
+}
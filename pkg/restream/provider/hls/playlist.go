@@ -27,7 +27,7 @@ func GetPlaylist(ctx context.Context, request request.Request, playlistURL strin
 	}
 	defer response.Body.Close()
 
-	pl, listType, err := m3u8.DecodeFrom(response.Body, true)
+	pl, listType, err := m3u8.DecodeWith(response.Body, true, customDecoders)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode playlist: %w", err)
 	}
@@ -0,0 +1,112 @@
+package hls
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grafov/m3u8"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/provider"
+)
+
+// selectRendition returns the rendition of renditionType in groupID matching the preference
+// by name or language, otherwise the default rendition. Audio falls back to the first
+// rendition of the group that can be selected automatically, or else the first one. Renditions without a URI are carried in the variant itself and
+// nil is returned for them.
+func (m *Master) selectRendition(renditionType, groupID string, preference provider.RenditionPreference) *m3u8.Alternative {
+	if groupID == "" {
+		return nil
+	}
+
+	// The playlist decoder links the EXT-X-MEDIA tags to the variant following them only,
+	// so the renditions of all the variants are searched.
+	renditions := make([]*m3u8.Alternative, 0)
+	for _, variant := range m.playlist.playlist.(*m3u8.MasterPlaylist).Variants {
+		if variant == nil {
+			continue
+		}
+
+		for _, rendition := range variant.Alternatives {
+			if rendition != nil && rendition.Type == renditionType && rendition.GroupId == groupID {
+				renditions = append(renditions, rendition)
+			}
+		}
+	}
+
+	selected := matchRendition(renditions, preference)
+	if selected == nil || selected.URI == "" {
+		return nil
+	}
+
+	return selected
+}
+
+func matchRendition(renditions []*m3u8.Alternative, preference provider.RenditionPreference) *m3u8.Alternative {
+	if preference.Name != "" {
+		for _, rendition := range renditions {
+			if strings.EqualFold(rendition.Name, preference.Name) {
+				return rendition
+			}
+		}
+	}
+
+	for _, language := range preference.Languages {
+		for _, rendition := range renditions {
+			if languageMatches(rendition.Language, language) {
+				return rendition
+			}
+		}
+	}
+
+	for _, rendition := range renditions {
+		if rendition.Default {
+			return rendition
+		}
+	}
+
+	if len(renditions) == 0 || renditions[0].Type != "AUDIO" {
+		return nil
+	}
+	for _, rendition := range renditions {
+		if strings.EqualFold(rendition.Autoselect, "YES") {
+			return rendition
+		}
+	}
+
+	return renditions[0]
+}
+
+// languageMatches returns whether the language tag of a rendition matches the preferred
+// language, ignoring case and any subtags of the rendition not in the preferred language.
+func languageMatches(language, preferred string) bool {
+	language = strings.ToLower(language)
+	preferred = strings.ToLower(preferred)
+
+	return language == preferred || strings.HasPrefix(language, preferred+"-")
+}
+
+// withRendition returns media following the playlist of rendition, or no playlist if
+// rendition is nil.
+func (m *Master) withRendition(media *Media, rendition *m3u8.Alternative) (*Media, error) {
+	if rendition == nil {
+		return media.WithPlaylistURL(""), nil
+	}
+
+	parsedURI, err := media.request.ResolveReference(rendition.URI, m.playlist.referenceURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve reference: %w", err)
+	}
+
+	return media.WithPlaylistURL(parsedURI.String()), nil
+}
+
+func renditionName(rendition *m3u8.Alternative) string {
+	switch {
+	case rendition == nil:
+		return ""
+	case rendition.Name != "":
+		return rendition.Name
+	default:
+		return rendition.Language
+	}
+}
@@ -0,0 +1,173 @@
+package hls
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/provider"
+	"github.com/shaunschembri/restreamer/pkg/restream/request"
+)
+
+const renditionsPlaylist = `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="lo",NAME="English",LANGUAGE="en",AUTOSELECT=NO,URI="lo/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="lo",NAME="Deutsch",LANGUAGE="de",AUTOSELECT=YES,URI="lo/de.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="hi",NAME="English",LANGUAGE="en",AUTOSELECT=YES,URI="hi/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="hi",NAME="Francais",LANGUAGE="fr-CA",AUTOSELECT=YES,URI="hi/fr.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="hi",NAME="Commentary",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,URI="hi/commentary.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="muxed",NAME="Main",LANGUAGE="en",DEFAULT=YES
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",LANGUAGE="en",DEFAULT=YES,URI="subs/en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="Espanol",LANGUAGE="es",URI="subs/es.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=500000,AUDIO="muxed"
+muxed.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,AUDIO="lo"
+lo.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,AUDIO="hi",SUBTITLES="subs"
+hi.m3u8
+`
+
+const renditionMedia = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:6
+#EXTINF:6.0,
+segment.ts
+#EXT-X-ENDLIST
+`
+
+func testMaster(t *testing.T, playlists map[string]string, preference provider.VariantPreference) *Master {
+	server := playlistServer(t, playlists)
+	// Requests are not retried, a missing playlist failing at once.
+	testRequest := request.New("test", request.WithRetryPolicy(request.RetryPolicy{MaxAttempts: 1}))
+
+	playlist, err := GetPlaylist(context.Background(), testRequest, server.URL+"/master.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewMaster(testRequest, 10000000).WithPlaylist(playlist).WithPreference(preference)
+}
+
+func TestSelectRendition(t *testing.T) {
+	tests := []struct {
+		name          string
+		bandwidth     uint32
+		preference    provider.VariantPreference
+		wantAudio     string
+		wantAudioName string
+		wantSubtitles string
+	}{
+		{
+			name:          "default",
+			bandwidth:     10000000,
+			wantAudio:     "/hi/commentary.m3u8",
+			wantAudioName: "Commentary",
+		},
+		{
+			name:          "language with subtag",
+			bandwidth:     10000000,
+			preference:    provider.VariantPreference{Audio: provider.RenditionPreference{Languages: []string{"FR"}}},
+			wantAudio:     "/hi/fr.m3u8",
+			wantAudioName: "Francais",
+		},
+		{
+			name:          "first available language",
+			bandwidth:     10000000,
+			preference:    provider.VariantPreference{Audio: provider.RenditionPreference{Languages: []string{"it", "en"}}},
+			wantAudio:     "/hi/en.m3u8",
+			wantAudioName: "English",
+		},
+		{
+			name:          "unavailable language",
+			bandwidth:     10000000,
+			preference:    provider.VariantPreference{Audio: provider.RenditionPreference{Languages: []string{"it"}}},
+			wantAudio:     "/hi/commentary.m3u8",
+			wantAudioName: "Commentary",
+		},
+		{
+			name:          "name",
+			bandwidth:     10000000,
+			preference:    provider.VariantPreference{Audio: provider.RenditionPreference{Name: "commentary", Languages: []string{"fr"}}},
+			wantAudio:     "/hi/commentary.m3u8",
+			wantAudioName: "Commentary",
+		},
+		{
+			name:          "group of the variant",
+			bandwidth:     1000000,
+			preference:    provider.VariantPreference{Audio: provider.RenditionPreference{Languages: []string{"en"}}},
+			wantAudio:     "/lo/en.m3u8",
+			wantAudioName: "English",
+		},
+		{
+			name:          "autoselect without default",
+			bandwidth:     1000000,
+			wantAudio:     "/lo/de.m3u8",
+			wantAudioName: "Deutsch",
+		},
+		{
+			name:      "carried in the variant",
+			bandwidth: 600000,
+		},
+		{
+			name:          "subtitles by language",
+			bandwidth:     10000000,
+			preference:    provider.VariantPreference{Subtitles: provider.RenditionPreference{Languages: []string{"es"}}},
+			wantAudio:     "/hi/commentary.m3u8",
+			wantAudioName: "Commentary",
+			wantSubtitles: "/subs/es.m3u8",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			master := testMaster(t, map[string]string{"/master.m3u8": renditionsPlaylist}, test.preference)
+			if err := master.selectVariant(test.bandwidth); err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.HasSuffix(master.audio.playlistURL, test.wantAudio) || (test.wantAudio == "") != (master.audio.playlistURL == "") {
+				t.Errorf("got audio playlist %q, want %q", master.audio.playlistURL, test.wantAudio)
+			}
+			if master.Variant().Audio != test.wantAudioName {
+				t.Errorf("got audio %q, want %q", master.Variant().Audio, test.wantAudioName)
+			}
+			if !strings.HasSuffix(master.subtitles.playlistURL, test.wantSubtitles) || (test.wantSubtitles == "") != (master.subtitles.playlistURL == "") {
+				t.Errorf("got subtitles playlist %q, want %q", master.subtitles.playlistURL, test.wantSubtitles)
+			}
+		})
+	}
+}
+
+func TestMasterSkipsFailedRendition(t *testing.T) {
+	// The playlist of the selected subtitles is missing.
+	master := testMaster(t, map[string]string{
+		"/master.m3u8":        renditionsPlaylist,
+		"/hi.m3u8":            renditionMedia,
+		"/hi/commentary.m3u8": renditionMedia,
+	}, provider.VariantPreference{Subtitles: provider.RenditionPreference{Languages: []string{"es"}}})
+
+	segments, _, err := master.Get(context.Background(), 10000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(segments) != 2 || segments[0].Track != provider.TrackMain || segments[1].Track != provider.TrackAudio {
+		t.Fatalf("got segments %+v", segments)
+	}
+	if tracks := master.Tracks(); len(tracks) != 2 || tracks[1] != provider.TrackAudio {
+		t.Fatalf("got tracks %v", tracks)
+	}
+	if !master.EndOfStream() {
+		t.Fatal("end of stream not detected without the failed rendition")
+	}
+}
+
+func TestMasterFailedVariant(t *testing.T) {
+	master := testMaster(t, map[string]string{
+		"/master.m3u8":        renditionsPlaylist,
+		"/hi/commentary.m3u8": renditionMedia,
+	}, provider.VariantPreference{})
+
+	if _, _, err := master.Get(context.Background(), 10000000); err == nil {
+		t.Fatal("expected an error when the variant playlist cannot be fetched")
+	}
+}
@@ -0,0 +1,89 @@
+package hls
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+const (
+	byteRangeTagName = "#EXT-X-BYTERANGE:"
+	gapTagName       = "#EXT-X-GAP"
+)
+
+// customDecoders decode the tags, or the parts of tags, not exposed by the playlist decoder.
+var customDecoders = []m3u8.CustomDecoder{byteRangeDecoder{}, gapDecoder{}}
+
+// byteRangeTag records whether an EXT-X-BYTERANGE tag has an offset since the playlist
+// decoder sets a missing offset to 0.
+type byteRangeTag struct {
+	hasOffset bool
+}
+
+func (t *byteRangeTag) TagName() string {
+	return byteRangeTagName
+}
+
+func (t *byteRangeTag) Encode() *bytes.Buffer {
+	return nil
+}
+
+func (t *byteRangeTag) String() string {
+	return ""
+}
+
+type byteRangeDecoder struct{}
+
+func (d byteRangeDecoder) TagName() string {
+	return byteRangeTagName
+}
+
+func (d byteRangeDecoder) Decode(line string) (m3u8.CustomTag, error) {
+	return &byteRangeTag{hasOffset: strings.Contains(line, "@")}, nil
+}
+
+func (d byteRangeDecoder) SegmentTag() bool {
+	return true
+}
+
+// gapTag marks a segment missing from the stream.
+type gapTag struct{}
+
+func (t gapTag) TagName() string {
+	return gapTagName
+}
+
+func (t gapTag) Encode() *bytes.Buffer {
+	return nil
+}
+
+func (t gapTag) String() string {
+	return ""
+}
+
+type gapDecoder struct{}
+
+func (d gapDecoder) TagName() string {
+	return gapTagName
+}
+
+func (d gapDecoder) Decode(line string) (m3u8.CustomTag, error) {
+	return gapTag{}, nil
+}
+
+func (d gapDecoder) SegmentTag() bool {
+	return true
+}
+
+// isGap returns whether the segment has an EXT-X-GAP tag.
+func isGap(segment *m3u8.MediaSegment) bool {
+	_, ok := segment.Custom[gapTagName]
+	return ok
+}
+
+// hasByteRangeOffset returns whether the EXT-X-BYTERANGE tag of the segment has an offset.
+func hasByteRangeOffset(segment *m3u8.MediaSegment) bool {
+	tag, ok := segment.Custom[byteRangeTagName].(*byteRangeTag)
+	return !ok || tag.hasOffset
+}
@@ -5,12 +5,107 @@ import (
 	"time"
 )
 
+// Track identifies the rendition a segment belongs to.
+type Track int
+
+const (
+	// TrackMain is the variant selected from a master playlist or the media playlist itself.
+	TrackMain Track = iota
+	// TrackAudio is an alternate audio rendition.
+	TrackAudio
+	// TrackSubtitles is a subtitles rendition.
+	TrackSubtitles
+)
+
+func (t Track) String() string {
+	switch t {
+	case TrackAudio:
+		return "audio"
+	case TrackSubtitles:
+		return "subtitles"
+	default:
+		return "main"
+	}
+}
+
 type Segment struct {
+	Track         Track
+	URL           string
+	ByteRange     ByteRange
+	MediaSequence uint64
+	KeyMethod     string
+	KeyURL        string
+	IV            string
+	Duration      float64
+	Map           *Map
+	// Discontinuity is set when the encoding, like the timestamps or the tracks, changes
+	// from the previous segment. DiscontinuitySequence counts these changes.
+	Discontinuity         bool
+	DiscontinuitySequence uint64
+	// ProgramDateTime is the date and time of the first sample of the segment, if known.
+	ProgramDateTime time.Time
+	Title           string
+	// Gap is set for segments missing from the stream, which are not downloaded.
+	Gap bool
+}
+
+// ByteRange is a sub-range of a resource. A zero Length means the whole resource.
+type ByteRange struct {
+	Length int64
+	Offset int64
+}
+
+// Map is the media initialization section needed to parse a segment, like the ftyp and
+// moov boxes of fragmented MP4 segments.
+type Map struct {
 	URL       string
-	KeyMethod string
-	KeyURL    string
-	IV        string
-	Duration  float64
+	ByteRange ByteRange
+}
+
+// VariantPreference restricts the variants a provider can select. Zero values apply no restriction.
+type VariantPreference struct {
+	MaxHeight    int
+	MinBandwidth uint32
+	Audio        RenditionPreference
+	// Subtitles are only selected when a language or name is set.
+	Subtitles RenditionPreference
+}
+
+// RenditionPreference selects an alternate rendition by name or by the first of the
+// languages available. Otherwise the default rendition is selected.
+type RenditionPreference struct {
+	Languages []string
+	Name      string
+}
+
+// Variant describes the variant of a master playlist selected by a provider together with
+// the names of its alternate renditions.
+type Variant struct {
+	URL        string
+	Bandwidth  uint32
+	Resolution string
+	Audio      string
+	Subtitles  string
+}
+
+// VariantProvider is implemented by providers selecting a variant of a master playlist.
+type VariantProvider interface {
+	// Variant returns the variant selected by the last call to Get.
+	Variant() Variant
+}
+
+// TrackProvider is implemented by providers returning segments of alternate renditions
+// together with the segments of the main track.
+type TrackProvider interface {
+	// Tracks returns the tracks of the segments returned by the last call to Get.
+	Tracks() []Track
+}
+
+// EndOfStreamProvider is implemented by providers of streams that can end, like VOD
+// playlists. Streams of other providers are restreamed until stopped.
+type EndOfStreamProvider interface {
+	// EndOfStream returns true once Get returned the last segment of the stream.
+	EndOfStream() bool
 }
 
 type Provider interface {
@@ -0,0 +1,175 @@
+package remux
+
+import (
+	"fmt"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/ts"
+)
+
+const (
+	audioStreamID = 0xc0
+	// Samples in an AAC frame.
+	aacFrameSamples = 1024
+)
+
+// Sampling frequencies of ADTS headers indexed by sampling_frequency_index.
+var adtsSampleRates = []uint64{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// audioInput splits the audio stream in PES packets. Packed audio is split in ADTS frames,
+// each in its own PES packet, while the PES packets of audio carried in MPEG-TS are kept
+// as they are.
+type audioInput struct {
+	buffer     []byte
+	streamType uint8
+	transport  bool
+	detected   bool
+	timestamp  uint64
+	timed      bool
+
+	pmtPIDs   map[uint16]bool
+	audioPID  uint16
+	pes       []byte
+	pesActive bool
+}
+
+func newAudioInput() audioInput {
+	return audioInput{pmtPIDs: make(map[uint16]bool)}
+}
+
+func (a *audioInput) write(p []byte) ([]unit, error) {
+	a.buffer = append(a.buffer, p...)
+
+	if !a.detected && len(a.buffer) > 0 {
+		a.transport = a.buffer[0] == ts.SyncByte
+		a.detected = true
+	}
+
+	if a.transport {
+		return a.readTransport(), nil
+	}
+
+	return a.readPacked()
+}
+
+// flush returns the PES packet still being read from an MPEG-TS audio stream.
+func (a *audioInput) flush() []unit {
+	if !a.pesActive {
+		return nil
+	}
+	a.pesActive = false
+
+	pes, err := ts.ParsePES(a.pes)
+	if err != nil {
+		return nil
+	}
+
+	audioUnit := unit{data: a.pes}
+	audioUnit.timestamp, audioUnit.timed = pes.PTS()
+
+	return []unit{audioUnit}
+}
+
+// readPacked reads the ID3 tags and ADTS frames of packed audio. Each segment starts with
+// an ID3 tag carrying the timestamp of its first frame, the timestamps of the following
+// frames are derived from the number of samples per frame.
+func (a *audioInput) readPacked() ([]unit, error) {
+	units := make([]unit, 0)
+
+	for len(a.buffer) > 0 {
+		switch {
+		case len(a.buffer) >= 3 && string(a.buffer[:3]) == "ID3":
+			if len(a.buffer) < id3HeaderSize {
+				return units, nil
+			}
+
+			size := id3TagSize(a.buffer)
+			if len(a.buffer) < size {
+				return units, nil
+			}
+
+			if timestamp, ok := id3Timestamp(a.buffer[:size]); ok {
+				a.timestamp, a.timed = timestamp, true
+			}
+			a.buffer = a.buffer[size:]
+
+		case len(a.buffer) >= 2 && a.buffer[0] == 0xff && a.buffer[1]&0xf0 == 0xf0:
+			if len(a.buffer) < 7 {
+				return units, nil
+			}
+
+			length := int(a.buffer[3]&0x03)<<11 | int(a.buffer[4])<<3 | int(a.buffer[5])>>5
+			sampleRateIndex := int(a.buffer[2]>>2) & 0x0f
+			if length < 7 || sampleRateIndex >= len(adtsSampleRates) {
+				return nil, fmt.Errorf("invalid ADTS frame")
+			}
+			if len(a.buffer) < length {
+				return units, nil
+			}
+
+			a.streamType = ts.StreamTypeADTS
+			frame := append([]byte(nil), a.buffer[:length]...)
+			units = append(units, unit{
+				timestamp: a.timestamp,
+				timed:     a.timed,
+				data:      ts.NewPES(audioStreamID, a.timestamp, frame).Encode(),
+			})
+
+			a.timestamp = (a.timestamp + aacFrameSamples*clockFrequency/adtsSampleRates[sampleRateIndex]) & timestampMask
+			a.buffer = a.buffer[length:]
+
+		case len(a.buffer) < 3:
+			return units, nil
+
+		default:
+			return nil, fmt.Errorf("unsupported packed audio, only ADTS is supported")
+		}
+	}
+
+	return units, nil
+}
+
+// readTransport reads the PES packets of the first elementary stream of an MPEG-TS
+// stream. A PES packet is complete once the next one starts.
+func (a *audioInput) readTransport() []unit {
+	units := make([]unit, 0)
+
+	for len(a.buffer) >= ts.PacketSize {
+		if a.buffer[0] != ts.SyncByte {
+			a.buffer = a.buffer[1:]
+			continue
+		}
+
+		packet := a.buffer[:ts.PacketSize]
+		a.buffer = a.buffer[ts.PacketSize:]
+		pid := ts.PID(packet)
+
+		switch {
+		case pid == ts.PATPID && ts.PayloadUnitStart(packet):
+			if section, err := ts.Section(ts.Payload(packet)); err == nil {
+				if pat, err := ts.ParsePAT(section); err == nil {
+					for _, pmtPID := range pat.Programs {
+						a.pmtPIDs[pmtPID] = true
+					}
+				}
+			}
+		case a.pmtPIDs[pid] && ts.PayloadUnitStart(packet):
+			if section, err := ts.Section(ts.Payload(packet)); err == nil {
+				if pmt, err := ts.ParsePMT(section); err == nil && len(pmt.Streams) > 0 {
+					a.audioPID = pmt.Streams[0].PID
+					a.streamType = pmt.Streams[0].Type
+				}
+			}
+		case pid == a.audioPID && a.audioPID != 0:
+			if ts.PayloadUnitStart(packet) {
+				units = append(units, a.flush()...)
+				a.pes = nil
+				a.pesActive = true
+			}
+			if a.pesActive {
+				a.pes = append(a.pes, ts.Payload(packet)...)
+			}
+		}
+	}
+
+	return units
+}
@@ -0,0 +1,80 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	id3HeaderSize = 10
+	// Owner of the PRIV frame carrying the MPEG-TS timestamp of packed audio as specified
+	// in https://tools.ietf.org/html/rfc8216#section-3.4
+	timestampOwner = "com.apple.streaming.transportStreamTimestamp"
+)
+
+// id3TagSize returns the size of the ID3 tag at the start of data, including its header
+// and footer.
+func id3TagSize(data []byte) int {
+	size := id3HeaderSize + syncSafe(data[6:10])
+	if data[5]&0x10 != 0 {
+		size += id3HeaderSize
+	}
+
+	return size
+}
+
+// id3Timestamp returns the MPEG-TS timestamp carried in the PRIV frame of an ID3 tag.
+func id3Timestamp(tag []byte) (uint64, bool) {
+	version := tag[3]
+	frames := tag[id3HeaderSize:]
+	if size := syncSafe(tag[6:10]); size < len(frames) {
+		frames = frames[:size]
+	}
+
+	for len(frames) >= id3HeaderSize && frames[0] != 0 {
+		size := int(binary.BigEndian.Uint32(frames[4:8]))
+		if version >= 4 {
+			size = syncSafe(frames[4:8])
+		}
+		if id3HeaderSize+size > len(frames) {
+			return 0, false
+		}
+
+		frame := frames[id3HeaderSize : id3HeaderSize+size]
+		if string(frames[:4]) == "PRIV" && bytes.HasPrefix(frame, []byte(timestampOwner+"\x00")) {
+			timestamp := frame[len(timestampOwner)+1:]
+			if len(timestamp) == 8 {
+				return binary.BigEndian.Uint64(timestamp) & timestampMask, true
+			}
+		}
+
+		frames = frames[id3HeaderSize+size:]
+	}
+
+	return 0, false
+}
+
+// id3TextTag returns an ID3v2.4 tag with a single TXXX frame.
+func id3TextTag(description, value string) []byte {
+	frame := []byte{0x03} // UTF-8
+	frame = append(frame, description...)
+	frame = append(frame, 0x00)
+	frame = append(frame, value...)
+
+	tag := []byte{'I', 'D', '3', 0x04, 0x00, 0x00}
+	tag = append(tag, toSyncSafe(id3HeaderSize+len(frame))...)
+	tag = append(tag, 'T', 'X', 'X', 'X')
+	tag = append(tag, toSyncSafe(len(frame))...)
+	tag = append(tag, 0x00, 0x00)
+
+	return append(tag, frame...)
+}
+
+// syncSafe decodes a 28-bit integer stored in 4 bytes using 7 bits each.
+func syncSafe(data []byte) int {
+	return int(data[0]&0x7f)<<21 | int(data[1]&0x7f)<<14 | int(data[2]&0x7f)<<7 | int(data[3]&0x7f)
+}
+
+func toSyncSafe(value int) []byte {
+	return []byte{byte(value>>21) & 0x7f, byte(value>>14) & 0x7f, byte(value>>7) & 0x7f, byte(value) & 0x7f}
+}
@@ -0,0 +1,420 @@
+// Package remux combines an MPEG-TS stream with audio and WebVTT subtitles provided as
+// separate streams, like the alternate renditions of an HLS master playlist, in a single
+// MPEG-TS stream.
+package remux
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/ts"
+)
+
+const (
+	firstPID        = 0x1100
+	timestampMask   = 1<<33 - 1
+	clockFrequency  = 90000
+	defaultMaxDelay = 30 * time.Second
+)
+
+// metadataDescriptor describes an ID3 timed metadata stream as specified in Apple's Timed
+// Metadata for HTTP Live Streaming.
+var metadataDescriptor = []byte{
+	ts.DescriptorMetadata, 0x0d, 0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0x00, 0x0f,
+}
+
+type unit struct {
+	timestamp uint64
+	timed     bool
+	data      []byte
+}
+
+// Remuxer writes the MPEG-TS stream written to Video to its output, adding the audio
+// written to Audio and the WebVTT subtitles written to Subtitles as additional streams of
+// the program, interleaved by their timestamps. Audio is either packed audio or an MPEG-TS
+// stream and subtitle cues are carried as ID3 timed metadata.
+type Remuxer struct {
+	// MaxDelay is how long the video is held back waiting for the audio with the same
+	// timestamps before it is written without it.
+	MaxDelay time.Duration
+
+	mutex       sync.Mutex
+	output      io.Writer
+	expectAudio bool
+
+	video     videoInput
+	audio     audioInput
+	subtitles subtitlesInput
+
+	videoQueue     []unit
+	audioQueue     []unit
+	subtitlesQueue []unit
+	heldAudio      []unit
+	heldSubtitles  []unit
+
+	lastVideoTimestamp uint64
+	hasVideoTimestamp  bool
+	lastAudioTimestamp uint64
+	hasAudioTimestamp  bool
+
+	audioStreamType  uint8
+	hasSubtitles     bool
+	audioPID         uint16
+	subtitlesPID     uint16
+	audioCounter     uint8
+	subtitlesCounter uint8
+	addedStreams     string
+	versionOffset    uint8
+}
+
+func New(output io.Writer) *Remuxer {
+	return &Remuxer{
+		MaxDelay: defaultMaxDelay,
+		output:   output,
+		video:    newVideoInput(),
+		audio:    newAudioInput(),
+	}
+}
+
+// ExpectAudio sets whether audio is expected to be written to Audio. While audio is
+// expected the video is held back until the audio with the same timestamps is written.
+func (r *Remuxer) ExpectAudio(expect bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.expectAudio = expect
+}
+
+func (r *Remuxer) Video() io.Writer {
+	return inputWriter{write: r.writeVideo}
+}
+
+// Audio returns the writer of the audio stream, whose EndSegment writes the last PES packet
+// of a segment without waiting for the next one.
+func (r *Remuxer) Audio() io.Writer {
+	return inputWriter{write: r.writeAudio, endSegment: r.endAudioSegment}
+}
+
+func (r *Remuxer) Subtitles() io.Writer {
+	return inputWriter{write: r.writeSubtitles, endSegment: r.endSubtitlesSegment}
+}
+
+// Flush writes all the data held back to the output once the inputs end.
+func (r *Remuxer) Flush() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.audioQueue = append(r.audioQueue, r.audio.flush()...)
+	r.subtitlesQueue = insertSorted(r.subtitlesQueue, r.subtitles.flush())
+
+	return r.interleave(true)
+}
+
+type inputWriter struct {
+	write      func(p []byte) (int, error)
+	endSegment func() error
+}
+
+func (w inputWriter) Write(p []byte) (int, error) {
+	return w.write(p)
+}
+
+func (w inputWriter) EndSegment() error {
+	if w.endSegment == nil {
+		return nil
+	}
+
+	return w.endSegment()
+}
+
+func (r *Remuxer) writeVideo(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, packet := range r.video.write(p) {
+		r.videoQueue = append(r.videoQueue, packet)
+		if packet.timed {
+			r.lastVideoTimestamp = packet.timestamp
+			r.hasVideoTimestamp = true
+		}
+	}
+
+	// Packets read before the first timestamp, like the PAT and PMT, take the timestamp
+	// of the first packet following them.
+	next := -1
+	for i := len(r.videoQueue) - 1; i >= 0; i-- {
+		switch {
+		case r.videoQueue[i].timed:
+			next = i
+		case next >= 0:
+			r.videoQueue[i].timestamp = r.videoQueue[next].timestamp
+			r.videoQueue[i].timed = true
+		}
+	}
+
+	return len(p), r.interleave(false)
+}
+
+func (r *Remuxer) writeAudio(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	units, err := r.audio.write(p)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, audioUnit := range units {
+		// Packed audio without a timestamp starts with the video.
+		if !audioUnit.timed {
+			audioUnit.timestamp = r.lastVideoTimestamp
+			audioUnit.timed = true
+		}
+
+		r.audioQueue = append(r.audioQueue, audioUnit)
+		r.lastAudioTimestamp = audioUnit.timestamp
+		r.hasAudioTimestamp = true
+	}
+	if r.audio.streamType != 0 {
+		r.audioStreamType = r.audio.streamType
+	}
+
+	return len(p), r.interleave(false)
+}
+
+func (r *Remuxer) endAudioSegment() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.audioQueue = append(r.audioQueue, r.audio.flush()...)
+
+	return r.interleave(false)
+}
+
+func (r *Remuxer) endSubtitlesSegment() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.subtitlesQueue = insertSorted(r.subtitlesQueue, r.subtitles.flush())
+
+	return r.interleave(false)
+}
+
+func (r *Remuxer) writeSubtitles(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.hasSubtitles = true
+	r.subtitlesQueue = insertSorted(r.subtitlesQueue, r.subtitles.write(p))
+
+	return len(p), r.interleave(false)
+}
+
+// interleave writes the queued video and audio in timestamp order. Data is held back
+// while data with an earlier timestamp can still be written to the other input, unless
+// flush is set or the data held back exceeds MaxDelay. Subtitles are written before the
+// first video or audio following them.
+func (r *Remuxer) interleave(flush bool) error {
+	output := bytes.Buffer{}
+	maxDelay := uint64(r.MaxDelay.Seconds() * clockFrequency)
+
+	for {
+		var next *unit
+		isVideo := false
+
+		switch {
+		case len(r.videoQueue) > 0 && len(r.audioQueue) > 0:
+			video, audio := &r.videoQueue[0], &r.audioQueue[0]
+			if !video.timed {
+				if !flush {
+					return r.write(output.Bytes())
+				}
+				next, isVideo = video, true
+			} else if !before(audio.timestamp, video.timestamp) {
+				next, isVideo = video, true
+			} else {
+				next = audio
+			}
+		case len(r.videoQueue) > 0:
+			video := &r.videoQueue[0]
+			switch {
+			case flush, !r.expectAudio:
+			case !video.timed:
+				return r.write(output.Bytes())
+			case r.hasAudioTimestamp && !before(r.lastAudioTimestamp, video.timestamp):
+			case distance(video.timestamp, r.lastVideoTimestamp) > maxDelay:
+			default:
+				return r.write(output.Bytes())
+			}
+			next, isVideo = video, true
+		case len(r.audioQueue) > 0:
+			audio := &r.audioQueue[0]
+			switch {
+			case flush:
+			case r.hasVideoTimestamp && !before(r.lastVideoTimestamp, audio.timestamp):
+			case distance(audio.timestamp, r.lastAudioTimestamp) > maxDelay:
+			default:
+				return r.write(output.Bytes())
+			}
+			next = audio
+		default:
+			for len(r.subtitlesQueue) > 0 &&
+				(flush || (r.hasVideoTimestamp && before(r.subtitlesQueue[0].timestamp, r.lastVideoTimestamp))) {
+				output.Write(r.subtitlesPackets(r.subtitlesQueue[0]))
+				r.subtitlesQueue = r.subtitlesQueue[1:]
+			}
+
+			return r.write(output.Bytes())
+		}
+
+		for len(r.subtitlesQueue) > 0 && next.timed && before(r.subtitlesQueue[0].timestamp, next.timestamp) {
+			output.Write(r.subtitlesPackets(r.subtitlesQueue[0]))
+			r.subtitlesQueue = r.subtitlesQueue[1:]
+		}
+
+		if isVideo {
+			output.Write(r.videoPacket(next.data))
+			r.videoQueue = r.videoQueue[1:]
+		} else {
+			output.Write(r.audioPackets(*next))
+			r.audioQueue = r.audioQueue[1:]
+		}
+	}
+}
+
+func (r *Remuxer) write(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	_, err := r.output.Write(data)
+	return err
+}
+
+// videoPacket returns a packet of the video input, adding the audio and subtitles streams
+// to the PMT.
+func (r *Remuxer) videoPacket(packet []byte) []byte {
+	if !r.video.pmtPIDs[ts.PID(packet)] || !ts.PayloadUnitStart(packet) {
+		return packet
+	}
+
+	section, err := ts.Section(ts.Payload(packet))
+	if err != nil {
+		return packet
+	}
+
+	pmt, err := ts.ParsePMT(section)
+	if err != nil {
+		return packet
+	}
+
+	added := ""
+	if r.audioStreamType != 0 {
+		r.audioPID = r.freePID(pmt, r.audioPID, r.subtitlesPID)
+		pmt.Streams = append(pmt.Streams, ts.PMTStream{Type: r.audioStreamType, PID: r.audioPID})
+		added += "audio"
+	}
+	if r.hasSubtitles {
+		r.subtitlesPID = r.freePID(pmt, r.subtitlesPID, r.audioPID)
+		pmt.Streams = append(pmt.Streams, ts.PMTStream{
+			Type:        ts.StreamTypeMetadata,
+			PID:         r.subtitlesPID,
+			Descriptors: metadataDescriptor,
+		})
+		added += "subtitles"
+	}
+
+	// The version is changed whenever the streams added change so that players parse
+	// the PMT again.
+	if added != r.addedStreams {
+		r.addedStreams = added
+		r.versionOffset++
+	}
+	pmt.Version = (pmt.Version + r.versionOffset) & 0x1f
+
+	counter := ts.ContinuityCounter(packet) - 1
+	packets := ts.Packetize(ts.PID(packet), ts.PSIPayload(pmt.Encode()), nil, &counter)
+
+	if r.audioPID != 0 {
+		for _, audio := range r.heldAudio {
+			packets = append(packets, r.audioPackets(audio)...)
+		}
+		r.heldAudio = nil
+	}
+	if r.subtitlesPID != 0 {
+		for _, subtitles := range r.heldSubtitles {
+			packets = append(packets, r.subtitlesPackets(subtitles)...)
+		}
+		r.heldSubtitles = nil
+	}
+
+	return packets
+}
+
+// freePID returns pid if it is set and not used by the PMT, otherwise the first PID from
+// firstPID not used by the PMT nor reserved.
+func (r *Remuxer) freePID(pmt *ts.PMT, pid, reserved uint16) uint16 {
+	used := map[uint16]bool{pmt.PCRPID: true, reserved: true}
+	for _, stream := range pmt.Streams {
+		used[stream.PID] = true
+	}
+	for pmtPID := range r.video.pmtPIDs {
+		used[pmtPID] = true
+	}
+
+	if pid != 0 && !used[pid] {
+		return pid
+	}
+
+	for pid = firstPID; used[pid]; pid++ {
+	}
+
+	return pid
+}
+
+// audioPackets returns the packets of an audio unit. Audio written before the first PMT,
+// which assigns its PID, is held back and written after the PMT.
+func (r *Remuxer) audioPackets(audio unit) []byte {
+	if r.audioPID == 0 {
+		r.heldAudio = append(r.heldAudio, audio)
+		return nil
+	}
+
+	return ts.Packetize(r.audioPID, audio.data, []byte{ts.AdaptationRandomAccess}, &r.audioCounter)
+}
+
+func (r *Remuxer) subtitlesPackets(subtitles unit) []byte {
+	if r.subtitlesPID == 0 {
+		r.heldSubtitles = append(r.heldSubtitles, subtitles)
+		return nil
+	}
+
+	return ts.Packetize(r.subtitlesPID, subtitles.data, nil, &r.subtitlesCounter)
+}
+
+// before returns whether timestamp a is before timestamp b, taking into account that
+// timestamps wrap around.
+func before(a, b uint64) bool {
+	return a != b && distance(a, b) < 1<<32
+}
+
+func distance(a, b uint64) uint64 {
+	return (b - a) & timestampMask
+}
+
+func insertSorted(queue []unit, units []unit) []unit {
+	for _, newUnit := range units {
+		i := len(queue)
+		for i > 0 && before(newUnit.timestamp, queue[i-1].timestamp) {
+			i--
+		}
+
+		queue = append(queue, unit{})
+		copy(queue[i+1:], queue[i:])
+		queue[i] = newUnit
+	}
+
+	return queue
+}
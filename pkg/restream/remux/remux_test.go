@@ -0,0 +1,264 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/ts"
+	"github.com/shaunschembri/restreamer/pkg/restream/ts/tstest"
+)
+
+// Duration of an AAC frame at 48kHz in 90kHz units.
+const testFrameDuration = aacFrameSamples * clockFrequency / 48000
+
+// videoSegment returns a segment of stream with a PAT, a PMT and a video PES packet for
+// every timestamp.
+func videoSegment(stream *tstest.Stream, timestamps ...uint64) []byte {
+	stream.Tables(tstest.PMT())
+	for _, timestamp := range timestamps {
+		stream.PES(tstest.VideoPID, ts.NewPES(0xe0, timestamp, []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xf0}), nil)
+	}
+
+	return stream.Segment()
+}
+
+// packedAudio returns packed audio with an ID3 tag carrying timestamp followed by frames
+// ADTS frames at 48kHz.
+func packedAudio(timestamp uint64, frames int) []byte {
+	priv := append([]byte(timestampOwner+"\x00"), make([]byte, 8)...)
+	binary.BigEndian.PutUint64(priv[len(priv)-8:], timestamp)
+
+	audio := []byte{'I', 'D', '3', 0x04, 0x00, 0x00}
+	audio = append(audio, toSyncSafe(id3HeaderSize+len(priv))...)
+	audio = append(audio, 'P', 'R', 'I', 'V')
+	audio = append(audio, toSyncSafe(len(priv))...)
+	audio = append(audio, 0x00, 0x00)
+	audio = append(audio, priv...)
+
+	for i := 0; i < frames; i++ {
+		length := 7 + 8
+		audio = append(audio, 0xff, 0xf1, 0x4c, 0x80|byte(length>>11), byte(length>>3), byte(length<<5)|0x1f, 0xfc)
+		audio = append(audio, bytes.Repeat([]byte{byte(i)}, 8)...)
+	}
+
+	return audio
+}
+
+type outputPacket struct {
+	pid       uint16
+	timestamp uint64
+	timed     bool
+	packet    []byte
+}
+
+// parseOutput splits the output in packets, returning the PID of the audio and subtitles
+// streams added to the PMT, with the PES timestamp of the packets starting one.
+func parseOutput(t *testing.T, output []byte) ([]outputPacket, uint16, uint16) {
+	t.Helper()
+
+	if len(output)%ts.PacketSize != 0 {
+		t.Fatalf("output size %d is not a multiple of %d", len(output), ts.PacketSize)
+	}
+
+	packets := make([]outputPacket, 0)
+	var audioPID, subtitlesPID uint16
+	for ; len(output) > 0; output = output[ts.PacketSize:] {
+		packet := outputPacket{pid: ts.PID(output), packet: output[:ts.PacketSize]}
+		if packet.packet[0] != ts.SyncByte {
+			t.Fatal("lost sync")
+		}
+
+		switch {
+		case packet.pid == tstest.PMTPID:
+			section, err := ts.Section(ts.Payload(packet.packet))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pmt, err := ts.ParsePMT(section)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, stream := range pmt.Streams {
+				switch stream.Type {
+				case ts.StreamTypeADTS:
+					audioPID = stream.PID
+				case ts.StreamTypeMetadata:
+					subtitlesPID = stream.PID
+				}
+			}
+		case packet.pid != ts.PATPID && ts.PayloadUnitStart(packet.packet):
+			pes, err := ts.ParsePES(ts.Payload(packet.packet))
+			if err != nil {
+				t.Fatal(err)
+			}
+			packet.timestamp, packet.timed = pes.PTS()
+		}
+
+		packets = append(packets, packet)
+	}
+
+	return packets, audioPID, subtitlesPID
+}
+
+// checkOrder checks that the PES packets of pids are written in timestamp order and
+// returns the number of PES packets of each of them.
+func checkOrder(t *testing.T, packets []outputPacket, pids ...uint16) map[uint16]int {
+	t.Helper()
+
+	counts := make(map[uint16]int)
+	var last uint64
+	for _, packet := range packets {
+		if !packet.timed {
+			continue
+		}
+		if packet.timestamp < last {
+			t.Fatalf("PES packet of PID %d with timestamp %d written after timestamp %d", packet.pid, packet.timestamp, last)
+		}
+		last = packet.timestamp
+		counts[packet.pid]++
+	}
+
+	for _, pid := range pids {
+		if pid == 0 {
+			t.Fatal("stream missing from PMT")
+		}
+	}
+
+	return counts
+}
+
+func TestRemuxerInterleave(t *testing.T) {
+	var output bytes.Buffer
+	remuxer := New(&output)
+	remuxer.ExpectAudio(true)
+
+	stream := tstest.NewStream()
+	video, audio := remuxer.Video(), remuxer.Audio()
+	for segment := uint64(0); segment < 3; segment++ {
+		start := 90000 + segment*20*testFrameDuration
+		timestamps := make([]uint64, 0)
+		for i := uint64(0); i < 10; i++ {
+			timestamps = append(timestamps, start+i*2*testFrameDuration)
+		}
+
+		if _, err := video.Write(videoSegment(stream, timestamps...)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := audio.Write(packedAudio(start, 20)); err != nil {
+			t.Fatal(err)
+		}
+		if err := audio.(inputWriter).EndSegment(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := remuxer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	packets, audioPID, _ := parseOutput(t, output.Bytes())
+	counts := checkOrder(t, packets, audioPID)
+	if counts[tstest.VideoPID] != 30 || counts[audioPID] != 60 {
+		t.Fatalf("got %d video and %d audio PES packets, want 30 and 60", counts[tstest.VideoPID], counts[audioPID])
+	}
+
+	var counter uint8
+	first := true
+	for _, packet := range packets {
+		if packet.pid != audioPID {
+			continue
+		}
+		if !first && ts.ContinuityCounter(packet.packet) != (counter+1)&0x0f {
+			t.Fatalf("audio continuity counter %d after %d", ts.ContinuityCounter(packet.packet), counter)
+		}
+		counter, first = ts.ContinuityCounter(packet.packet), false
+	}
+}
+
+func TestRemuxerAudioBeforePMT(t *testing.T) {
+	var output bytes.Buffer
+	remuxer := New(&output)
+	remuxer.ExpectAudio(true)
+
+	// The audio starts five frames before the video.
+	if _, err := remuxer.Audio().Write(packedAudio(90000-5*testFrameDuration, 10)); err != nil {
+		t.Fatal(err)
+	}
+	stream := tstest.NewStream()
+	if _, err := remuxer.Video().Write(videoSegment(stream, 90000, 90000+2*testFrameDuration)); err != nil {
+		t.Fatal(err)
+	}
+	if err := remuxer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	packets, audioPID, _ := parseOutput(t, output.Bytes())
+	if audioPID == 0 {
+		t.Fatal("audio missing from PMT")
+	}
+
+	pmtWritten := false
+	audioFrames := 0
+	for _, packet := range packets {
+		switch {
+		case packet.pid == tstest.PMTPID:
+			pmtWritten = true
+		case packet.pid == audioPID && packet.timed:
+			if !pmtWritten {
+				t.Fatal("audio written before the PMT")
+			}
+			audioFrames++
+		}
+	}
+	if audioFrames != 10 {
+		t.Fatalf("got %d audio frames, want 10", audioFrames)
+	}
+}
+
+func TestRemuxerSubtitles(t *testing.T) {
+	var output bytes.Buffer
+	remuxer := New(&output)
+
+	subtitles := strings.Join([]string{
+		"WEBVTT",
+		"X-TIMESTAMP-MAP=MPEGTS:90000,LOCAL:00:00:00.000",
+		"",
+		"00:00:00.500 --> 00:00:01.000",
+		"First cue",
+		"",
+		"00:00:01.500 --> 00:00:02.000",
+		"Second cue",
+	}, "\n")
+
+	writer := remuxer.Subtitles()
+	if _, err := writer.Write([]byte(subtitles)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.(inputWriter).EndSegment(); err != nil {
+		t.Fatal(err)
+	}
+	stream := tstest.NewStream()
+	if _, err := remuxer.Video().Write(videoSegment(stream, 90000, 90000+clockFrequency, 90000+2*clockFrequency)); err != nil {
+		t.Fatal(err)
+	}
+	if err := remuxer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	packets, _, subtitlesPID := parseOutput(t, output.Bytes())
+	counts := checkOrder(t, packets, subtitlesPID)
+	if counts[subtitlesPID] != 2 {
+		t.Fatalf("got %d cues, want 2", counts[subtitlesPID])
+	}
+
+	var cues []byte
+	for _, packet := range packets {
+		if packet.pid == subtitlesPID {
+			cues = append(cues, ts.Payload(packet.packet)...)
+		}
+	}
+	if !bytes.Contains(cues, []byte("First cue")) || !bytes.Contains(cues, []byte("Second cue")) {
+		t.Fatal("cues missing from the subtitles stream")
+	}
+}
@@ -0,0 +1,83 @@
+package remux
+
+import (
+	"github.com/shaunschembri/restreamer/pkg/restream/ts"
+)
+
+// videoInput splits the MPEG-TS stream in packets, each with the decoding timestamp of
+// the last PES packet started before it.
+type videoInput struct {
+	partial    []byte
+	pmtPIDs    map[uint16]bool
+	elementary map[uint16]bool
+	timestamp  uint64
+	timed      bool
+}
+
+func newVideoInput() videoInput {
+	return videoInput{
+		pmtPIDs:    make(map[uint16]bool),
+		elementary: make(map[uint16]bool),
+	}
+}
+
+func (v *videoInput) write(p []byte) []unit {
+	v.partial = append(v.partial, p...)
+	units := make([]unit, 0, len(v.partial)/ts.PacketSize)
+
+	for len(v.partial) >= ts.PacketSize {
+		if v.partial[0] != ts.SyncByte {
+			v.partial = v.partial[1:]
+			continue
+		}
+
+		packet := make([]byte, ts.PacketSize)
+		copy(packet, v.partial)
+		v.partial = v.partial[ts.PacketSize:]
+
+		v.inspect(packet)
+		units = append(units, unit{timestamp: v.timestamp, timed: v.timed, data: packet})
+	}
+
+	return units
+}
+
+// inspect follows the PAT and PMT to find the elementary streams and reads the timestamps
+// of their PES packets. The decoding timestamp is used as it increases monotonically,
+// unlike the presentation timestamp of video with B-frames.
+func (v *videoInput) inspect(packet []byte) {
+	pid := ts.PID(packet)
+	if !ts.PayloadUnitStart(packet) {
+		return
+	}
+
+	switch {
+	case pid == ts.PATPID:
+		if section, err := ts.Section(ts.Payload(packet)); err == nil {
+			if pat, err := ts.ParsePAT(section); err == nil {
+				for _, pmtPID := range pat.Programs {
+					v.pmtPIDs[pmtPID] = true
+				}
+			}
+		}
+	case v.pmtPIDs[pid]:
+		if section, err := ts.Section(ts.Payload(packet)); err == nil {
+			if pmt, err := ts.ParsePMT(section); err == nil {
+				for _, stream := range pmt.Streams {
+					v.elementary[stream.PID] = true
+				}
+			}
+		}
+	case v.elementary[pid]:
+		pes, err := ts.ParsePES(ts.Payload(packet))
+		if err != nil {
+			return
+		}
+
+		if dts, ok := pes.DTS(); ok {
+			v.timestamp, v.timed = dts, true
+		} else if pts, ok := pes.PTS(); ok {
+			v.timestamp, v.timed = pts, true
+		}
+	}
+}
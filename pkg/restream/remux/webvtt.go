@@ -0,0 +1,144 @@
+package remux
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/ts"
+)
+
+const (
+	// Stream id of private_stream_1 used for ID3 timed metadata.
+	metadataStreamID = 0xbd
+	cueDescription   = "WebVTT"
+)
+
+// subtitlesInput splits WebVTT segments in cues. The cue times are mapped to MPEG-TS
+// timestamps using the X-TIMESTAMP-MAP header of the segment as specified in
+// https://tools.ietf.org/html/rfc8216#section-3.5
+type subtitlesInput struct {
+	buffer string
+	mpegts uint64
+	local  uint64
+}
+
+func (s *subtitlesInput) write(p []byte) []unit {
+	s.buffer += strings.ReplaceAll(string(p), "\r\n", "\n")
+
+	units := make([]unit, 0)
+	for {
+		end := strings.Index(s.buffer, "\n\n")
+		if end < 0 {
+			return units
+		}
+
+		block := s.buffer[:end]
+		s.buffer = strings.TrimLeft(s.buffer[end:], "\n")
+		units = append(units, s.readBlock(block)...)
+	}
+}
+
+// flush returns the cue of the last block, which is not followed by an empty line.
+func (s *subtitlesInput) flush() []unit {
+	block := strings.TrimSpace(s.buffer)
+	s.buffer = ""
+
+	return s.readBlock(block)
+}
+
+func (s *subtitlesInput) readBlock(block string) []unit {
+	lines := strings.Split(strings.Trim(block, "\n"), "\n")
+
+	// A segment not ending with an empty line is followed directly by the header of the
+	// next segment.
+	for i, line := range lines {
+		if i > 0 && strings.HasPrefix(line, "WEBVTT") {
+			return append(s.readBlock(strings.Join(lines[:i], "\n")), s.readBlock(strings.Join(lines[i:], "\n"))...)
+		}
+	}
+
+	if strings.HasPrefix(lines[0], "WEBVTT") {
+		s.readHeader(lines[1:])
+		return nil
+	}
+
+	for i, line := range lines {
+		if !strings.Contains(line, "-->") {
+			continue
+		}
+
+		start, err := parseCueTime(strings.TrimSpace(strings.SplitN(line, "-->", 2)[0]))
+		if err != nil {
+			return nil
+		}
+
+		timestamp := (s.mpegts + start - s.local) & timestampMask
+		cue := strings.Join(lines[i:], "\n")
+		pes := ts.NewPES(metadataStreamID, timestamp, id3TextTag(cueDescription, cue))
+		pes.Header[6] |= 0x04 // data_alignment_indicator
+
+		return []unit{{timestamp: timestamp, timed: true, data: pes.Encode()}}
+	}
+
+	// NOTE, STYLE and REGION blocks carry no cue.
+	return nil
+}
+
+// readHeader reads the X-TIMESTAMP-MAP header, resetting the mapping when the segment
+// has none.
+func (s *subtitlesInput) readHeader(lines []string) {
+	s.mpegts, s.local = 0, 0
+
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "X-TIMESTAMP-MAP=") {
+			continue
+		}
+
+		for _, attribute := range strings.Split(strings.TrimPrefix(line, "X-TIMESTAMP-MAP="), ",") {
+			parts := strings.SplitN(attribute, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			switch parts[0] {
+			case "MPEGTS":
+				if mpegts, err := strconv.ParseUint(parts[1], 10, 64); err == nil {
+					s.mpegts = mpegts
+				}
+			case "LOCAL":
+				if local, err := parseCueTime(parts[1]); err == nil {
+					s.local = local
+				}
+			}
+		}
+	}
+}
+
+// parseCueTime parses a WebVTT timestamp, hh:mm:ss.ttt or mm:ss.ttt, in 90kHz units.
+func parseCueTime(value string) (uint64, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid cue time %s", value)
+	}
+
+	var hours, minutes uint64
+	var err error
+	if len(parts) == 3 {
+		if hours, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid cue time %s: %w", value, err)
+		}
+		parts = parts[1:]
+	}
+
+	if minutes, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return 0, fmt.Errorf("invalid cue time %s: %w", value, err)
+	}
+
+	seconds, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cue time %s: %w", value, err)
+	}
+
+	return (hours*3600+minutes*60)*clockFrequency + uint64(seconds*clockFrequency+0.5), nil
+}
@@ -0,0 +1,305 @@
+package request
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func okHandler(writer http.ResponseWriter, request *http.Request) {
+	io.WriteString(writer, "ok")
+}
+
+func get(t *testing.T, client *http.Client, url string) (string, error) {
+	t.Helper()
+
+	response, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	return string(body), err
+}
+
+func writePEM(t *testing.T, name, blockType string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// clientCertificate creates a self-signed client certificate returning it together with
+// the paths of its certificate and key files.
+func clientCertificate(t *testing.T) (*x509.Certificate, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "restreamer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate, writePEM(t, "client.pem", "CERTIFICATE", der), writePEM(t, "client-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func TestNewClientWithConfigTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(okHandler))
+	defer server.Close()
+
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+
+	tests := []struct {
+		name    string
+		config  TransportConfig
+		wantErr bool
+	}{
+		{name: "default", config: TransportConfig{}, wantErr: true},
+		{name: "ca file", config: TransportConfig{CAFile: caFile}},
+		{name: "insecure", config: TransportConfig{InsecureSkipVerify: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := NewClientWithConfig(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := get(t, client, server.URL)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected certificate verification to fail")
+				}
+				return
+			}
+			if err != nil || body != "ok" {
+				t.Fatalf("got %q, %v", body, err)
+			}
+		})
+	}
+}
+
+func TestNewClientWithConfigClientCertificate(t *testing.T) {
+	certificate, certFile, keyFile := clientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(certificate)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(okHandler))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+
+	client, err := NewClientWithConfig(TransportConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := get(t, client, server.URL); err != nil || body != "ok" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+
+	client, err = NewClientWithConfig(TransportConfig{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(t, client, server.URL); err == nil {
+		t.Fatal("expected request without client certificate to fail")
+	}
+}
+
+func TestNewClientWithConfigProxy(t *testing.T) {
+	var proxiedURL string
+	proxy := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		proxiedURL = request.URL.String()
+		okHandler(writer, request)
+	}))
+	defer proxy.Close()
+
+	client, err := NewClientWithConfig(TransportConfig{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := get(t, client, "http://example.invalid/media.m3u8")
+	if err != nil || body != "ok" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+	if proxiedURL != "http://example.invalid/media.m3u8" {
+		t.Fatalf("proxy received %q", proxiedURL)
+	}
+}
+
+// socks5Proxy accepts SOCKS5 connections without authentication, connecting them to target
+// whatever address they request. The addresses requested are sent to requested.
+func socks5Proxy(t *testing.T, target string, requested chan<- string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, target, requested)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveSOCKS5(conn net.Conn, target string, requested chan<- string) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 5 {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		address := make([]byte, 4)
+		if _, err := io.ReadFull(conn, address); err != nil {
+			return
+		}
+		host = net.IP(address).String()
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		address := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, address); err != nil {
+			return
+		}
+		host = string(address)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	requested <- net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func TestNewClientWithConfigSOCKS5Proxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(okHandler))
+	defer server.Close()
+
+	requested := make(chan string, 1)
+	proxy := socks5Proxy(t, server.Listener.Addr().String(), requested)
+
+	client, err := NewClientWithConfig(TransportConfig{ProxyURL: "socks5://" + proxy})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := get(t, client, "http://example.invalid:8080/media.m3u8")
+	if err != nil || body != "ok" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+	if address := <-requested; address != "example.invalid:8080" {
+		t.Fatalf("proxy was asked to connect to %s", address)
+	}
+}
+
+func TestNewClientWithConfigErrors(t *testing.T) {
+	emptyCAFile := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(emptyCAFile, []byte("no certificates"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config TransportConfig
+	}{
+		{name: "proxy scheme", config: TransportConfig{ProxyURL: "ftp://127.0.0.1:21"}},
+		{name: "proxy url", config: TransportConfig{ProxyURL: "http://[::1"}},
+		{name: "missing ca file", config: TransportConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}},
+		{name: "empty ca file", config: TransportConfig{CAFile: emptyCAFile}},
+		{name: "missing key file", config: TransportConfig{CertFile: emptyCAFile}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewClientWithConfig(test.config); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
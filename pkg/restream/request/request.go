@@ -4,76 +4,257 @@ import (
 	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
 type Request struct {
-	client    *http.Client
-	userAgent string
+	client      *http.Client
+	userAgent   string
+	headers     http.Header
+	username    string
+	password    string
+	bearerToken string
+	authHosts   []string
+	cookieJar   http.CookieJar
+	retryPolicy RetryPolicy
+	onRetry     func(retry Retry)
 }
 
-func New(userAgent string) Request {
-	return Request{
-		client:    &http.Client{},
-		userAgent: userAgent,
+// Option configures a Request created by New.
+type Option func(*Request)
+
+// WithHeaders adds static headers to every request.
+func WithHeaders(headers http.Header) Option {
+	return func(r *Request) {
+		r.headers = headers
+	}
+}
+
+// WithBasicAuth authenticates requests to the hosts set with WithAuthHosts using HTTP basic
+// authentication.
+func WithBasicAuth(username, password string) Option {
+	return func(r *Request) {
+		r.username = username
+		r.password = password
+	}
+}
+
+// WithBearerToken authenticates requests to the hosts set with WithAuthHosts with a bearer
+// token.
+func WithBearerToken(token string) Option {
+	return func(r *Request) {
+		r.bearerToken = token
+	}
+}
+
+// WithAuthHosts adds hosts, with or without port, credentials are sent to. Credentials are
+// not sent to any other host.
+func WithAuthHosts(hosts ...string) Option {
+	return func(r *Request) {
+		r.authHosts = append(r.authHosts, hosts...)
 	}
 }
 
+// WithCookieJar stores cookies set by responses in jar and sends them with subsequent
+// requests. Requests sharing the same jar share their cookies.
+func WithCookieJar(jar http.CookieJar) Option {
+	return func(r *Request) {
+		r.cookieJar = jar
+	}
+}
+
+// WithClient makes the request use client instead of creating a new one. Requests
+// sharing a client reuse its connections.
+func WithClient(client *http.Client) Option {
+	return func(r *Request) {
+		r.client = client
+	}
+}
+
+func New(userAgent string, options ...Option) Request {
+	request := Request{
+		userAgent:   userAgent,
+		retryPolicy: DefaultRetryPolicy(),
+	}
+
+	for _, option := range options {
+		option(&request)
+	}
+
+	if request.client == nil {
+		request.client = NewClient()
+	}
+
+	// The client is copied so that a client shared with other requests is not modified.
+	// The copy still shares the transport and therefore its connections.
+	if request.cookieJar != nil {
+		client := *request.client
+		client.Jar = request.cookieJar
+		request.client = &client
+	}
+
+	return request
+}
+
+// Do requests requestURL retrying failed attempts according to the retry policy. When the
+// request is not retried any more a *RetryError wrapping the error of the last attempt,
+// possibly a *StatusError, is returned.
 func (r Request) Do(ctx context.Context, requestURL string) (*http.Response, error) {
-	for {
+	return r.do(ctx, requestURL, "")
+}
+
+// DoRange requests length bytes of requestURL starting at offset using a Range request.
+// When the server ignores the Range header and responds with the whole resource, the
+// response body is trimmed to the requested range.
+func (r Request) DoRange(ctx context.Context, requestURL string, offset, length int64) (*http.Response, error) {
+	response, err := r.do(ctx, requestURL, fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusPartialContent {
+		contentRange := response.Header.Get("Content-Range")
+		if !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", offset)) {
+			response.Body.Close()
+			return nil, fmt.Errorf("unexpected content range %q for offset %d of %s", contentRange, offset, requestURL)
+		}
+
+		return response, nil
+	}
+
+	if _, err := io.CopyN(io.Discard, response.Body, offset); err != nil {
+		response.Body.Close()
+		return nil, fmt.Errorf("cannot skip to offset %d of %s: %w", offset, requestURL, err)
+	}
+	response.Body = rangeBody{Reader: io.LimitReader(response.Body, length), Closer: response.Body}
+
+	return response, nil
+}
+
+func (r Request) do(ctx context.Context, requestURL, byteRange string) (*http.Response, error) {
+	startTime := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		response, err := r.attemptRequest(ctx, requestURL, byteRange)
+		if err == nil {
+			return response, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("request to %s aborted as context cancelled: %w", requestURL, ctx.Err())
+		}
+
+		elapsed := time.Since(startTime)
+		wait := r.retryPolicy.backoff(attempt, err)
+
+		maxAttempts := r.retryPolicy.maxAttempts(err)
+		if (maxAttempts > 0 && attempt >= maxAttempts) ||
+			(r.retryPolicy.MaxElapsedTime > 0 && elapsed+wait > r.retryPolicy.MaxElapsedTime) {
+			return nil, &RetryError{URL: requestURL, Attempts: attempt, Elapsed: elapsed, Err: err}
+		}
+
+		log.Printf("%v. Will retry in %v", err, wait.Round(time.Millisecond))
+		if r.onRetry != nil {
+			r.onRetry(Retry{URL: requestURL, Attempt: attempt, Wait: wait, Err: err})
+		}
+
+		timer := time.NewTimer(wait)
 		select {
 		case <-ctx.Done():
-			return nil, fmt.Errorf("request to %s aborted as context cancelled", requestURL)
-		default:
-			response, err := r.attemptRequest(ctx, requestURL)
-			if err != nil || response == nil {
-				log.Printf("request to %s failed with error %v. Will retry in 1 second", requestURL, err)
-				time.Sleep(time.Second)
-				continue
-			}
-
-			if response.StatusCode < http.StatusBadRequest {
-				return response, nil
-			}
-
-			if response.StatusCode != http.StatusNotFound {
-				log.Printf("request to %s failed with status code %d. Will retry in 1 second", requestURL, response.StatusCode)
-				time.Sleep(time.Second)
-				continue
-			}
-
-			return nil, fmt.Errorf("request to %s failed with status code %d", requestURL, response.StatusCode)
+			timer.Stop()
+			return nil, fmt.Errorf("request to %s aborted as context cancelled: %w", requestURL, ctx.Err())
+		case <-timer.C:
 		}
 	}
 }
 
-func (r Request) attemptRequest(context context.Context, requestURL string) (*http.Response, error) {
+func (r Request) attemptRequest(context context.Context, requestURL, byteRange string) (*http.Response, error) {
 	request, err := http.NewRequestWithContext(context, "GET", requestURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %w", err)
 	}
-	request.Header.Add("User-Agent", r.userAgent)
-	request.Header.Add("Accept-Encoding", "gzip")
+	for name, values := range r.headers {
+		for _, value := range values {
+			request.Header.Add(name, value)
+		}
+	}
+	request.Header.Set("User-Agent", r.userAgent)
+
+	// Byte ranges refer to the resource as stored so range requests are not compressed.
+	if byteRange != "" {
+		request.Header.Set("Range", byteRange)
+		request.Header.Set("Accept-Encoding", "identity")
+	} else {
+		request.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	switch {
+	case !r.authHost(request.URL):
+	case r.bearerToken != "":
+		request.Header.Set("Authorization", "Bearer "+r.bearerToken)
+	case r.username != "" || r.password != "":
+		request.SetBasicAuth(r.username, r.password)
+	}
 
 	response, err := r.client.Do(request)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request: %w", err)
+		return nil, fmt.Errorf("request to %s failed: %w", requestURL, err)
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		response.Body.Close()
+		return nil, &StatusError{
+			URL:        requestURL,
+			StatusCode: response.StatusCode,
+			RetryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+		}
 	}
 
 	if response.Header.Get("Content-Encoding") == "gzip" {
 		reader, err := gzip.NewReader(response.Body)
 		if err != nil {
+			response.Body.Close()
 			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
 		}
-		response.Body = reader
+		response.Body = gzipBody{Reader: reader, body: response.Body}
 	}
 
 	return response, nil
 }
 
+func (r Request) authHost(requestURL *url.URL) bool {
+	for _, host := range r.authHosts {
+		if strings.EqualFold(host, requestURL.Host) || strings.EqualFold(host, requestURL.Hostname()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// gzipBody closes the original response body together with the gzip reader so that the
+// connection can be reused.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (g gzipBody) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+// rangeBody limits a response body ignoring a Range request to the requested range.
+type rangeBody struct {
+	io.Reader
+	io.Closer
+}
+
 func (r Request) ResolveReference(uri string, referenceURL *url.URL) (*url.URL, error) {
 	parsedURI, err := url.Parse(uri)
 	if err != nil {
@@ -0,0 +1,91 @@
+package request
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const rangeContent = "0123456789abcdefghij"
+
+func TestDoRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr bool
+	}{
+		{
+			name: "partial content",
+			handler: func(writer http.ResponseWriter, request *http.Request) {
+				if request.Header.Get("Range") != "bytes=5-9" || request.Header.Get("Accept-Encoding") != "identity" {
+					t.Errorf("got Range %q and Accept-Encoding %q", request.Header.Get("Range"), request.Header.Get("Accept-Encoding"))
+				}
+				http.ServeContent(writer, request, "segment.ts", time.Time{}, strings.NewReader(rangeContent))
+			},
+		},
+		{
+			name: "invalid content range",
+			handler: func(writer http.ResponseWriter, request *http.Request) {
+				writer.Header().Set("Content-Range", "bytes 0-4/20")
+				writer.WriteHeader(http.StatusPartialContent)
+				io.WriteString(writer, rangeContent[:5])
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing content range",
+			handler: func(writer http.ResponseWriter, request *http.Request) {
+				writer.WriteHeader(http.StatusPartialContent)
+				io.WriteString(writer, rangeContent[5:10])
+			},
+			wantErr: true,
+		},
+		{
+			name: "range ignored",
+			handler: func(writer http.ResponseWriter, request *http.Request) {
+				io.WriteString(writer, rangeContent)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(test.handler)
+			defer server.Close()
+
+			response, err := New("test", WithRetryPolicy(testPolicy())).DoRange(context.Background(), server.URL, 5, 5)
+			if test.wantErr {
+				if err == nil {
+					response.Body.Close()
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			body, err := io.ReadAll(response.Body)
+			if err != nil || string(body) != "56789" {
+				t.Fatalf("got body %q, %v", body, err)
+			}
+		})
+	}
+}
+
+func TestDoRangeShortResource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		io.WriteString(writer, rangeContent[:3])
+	}))
+	defer server.Close()
+
+	// The whole resource returned ignoring the range ends before the offset.
+	if _, err := New("test", WithRetryPolicy(testPolicy())).DoRange(context.Background(), server.URL, 5, 5); err == nil {
+		t.Fatal("expected an error")
+	}
+}
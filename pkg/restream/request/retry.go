@@ -0,0 +1,150 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed requests are retried. Zero values for MaxAttempts
+// and MaxElapsedTime mean that there is no limit.
+type RetryPolicy struct {
+	MaxAttempts    int
+	MaxElapsedTime time.Duration
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter randomises each backoff by up to this fraction of its value.
+	Jitter float64
+	// StatusCodeAttempts overrides MaxAttempts for responses with a specific status
+	// code. A value of 1 fails the request on the first response with that status code.
+	StatusCodeAttempts map[int]int
+}
+
+// DefaultRetryPolicy retries transient errors for up to two minutes. As segments of a
+// live stream might not be available yet a 404 is retried a few times before giving up.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxElapsedTime: 2 * time.Minute,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		StatusCodeAttempts: map[int]int{
+			http.StatusBadRequest:   1,
+			http.StatusUnauthorized: 1,
+			http.StatusNotFound:     4,
+			http.StatusGone:         1,
+		},
+	}
+}
+
+// StatusError is returned when a request fails with an HTTP error status code.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request to %s failed with status code %d", e.URL, e.StatusCode)
+}
+
+// RetryError is returned when a request is not retried any more. Err holds the error of
+// the last attempt.
+type RetryError struct {
+	URL      string
+	Attempts int
+	Elapsed  time.Duration
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("giving up request to %s after %d attempts in %v: %v", e.URL, e.Attempts, e.Elapsed.Round(time.Millisecond), e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Retry describes a failed attempt of a request that is retried after Wait. Err is the error
+// of the attempt, possibly a *StatusError.
+type Retry struct {
+	URL     string
+	Attempt int
+	Wait    time.Duration
+	Err     error
+}
+
+// WithOnRetry calls onRetry whenever a failed attempt is retried. It may be called
+// concurrently by requests made at the same time.
+func WithOnRetry(onRetry func(retry Retry)) Option {
+	return func(r *Request) {
+		r.onRetry = onRetry
+	}
+}
+
+// WithRetryPolicy replaces the default retry policy.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(r *Request) {
+		r.retryPolicy = policy
+	}
+}
+
+// maxAttempts returns the number of attempts allowed for err, 0 being unlimited.
+func (p RetryPolicy) maxAttempts(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		if attempts, ok := p.StatusCodeAttempts[statusErr.StatusCode]; ok {
+			return attempts
+		}
+	}
+
+	return p.MaxAttempts
+}
+
+// backoff returns the time to wait before the next attempt, attempt being the number
+// of attempts done so far.
+func (p RetryPolicy) backoff(attempt int, err error) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+
+	if p.Jitter > 0 {
+		backoff += backoff * p.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	wait := time.Duration(backoff)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > wait {
+		wait = statusErr.RetryAfter
+	}
+
+	return wait
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
@@ -0,0 +1,207 @@
+package request
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPolicy returns a policy retrying every error with backoffs short enough for tests.
+func testPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialBackoff:     time.Millisecond,
+		MaxBackoff:         4 * time.Millisecond,
+		Multiplier:         2,
+		StatusCodeAttempts: make(map[int]int),
+	}
+}
+
+// failingServer responds with statusCode to the first failures requests and with "ok"
+// afterwards, returning the number of requests received.
+func failingServer(t *testing.T, failures int32, statusCode int, header http.Header) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			for name, values := range header {
+				writer.Header()[name] = values
+			}
+			writer.WriteHeader(statusCode)
+			return
+		}
+		io.WriteString(writer, "ok")
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Multiplier: 2}
+	for attempt, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if backoff := policy.backoff(attempt+1, errors.New("failed")); backoff != want*time.Millisecond {
+			t.Errorf("attempt %d has backoff %v, want %v", attempt+1, backoff, want*time.Millisecond)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if backoff := policy.backoff(2, errors.New("failed")); backoff < 10*time.Millisecond || backoff > 30*time.Millisecond {
+			t.Fatalf("backoff %v with jitter out of range", backoff)
+		}
+	}
+
+	policy.Jitter = 0
+	if backoff := policy.backoff(1, &StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: time.Second}); backoff != time.Second {
+		t.Fatalf("got backoff %v, want the Retry-After of 1s", backoff)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if wait := parseRetryAfter("3"); wait != 3*time.Second {
+		t.Fatalf("got %v for seconds", wait)
+	}
+	if wait := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); wait < 58*time.Second || wait > time.Minute {
+		t.Fatalf("got %v for a date", wait)
+	}
+	if wait := parseRetryAfter("soon"); wait != 0 {
+		t.Fatalf("got %v for an invalid value", wait)
+	}
+}
+
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	server, requests := failingServer(t, 2, http.StatusServiceUnavailable, nil)
+
+	var retries []Retry
+	request := New("test", WithRetryPolicy(testPolicy()), WithOnRetry(func(retry Retry) {
+		retries = append(retries, retry)
+	}))
+
+	response, err := request.Do(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if body, _ := io.ReadAll(response.Body); string(body) != "ok" {
+		t.Fatalf("got body %q", body)
+	}
+	if atomic.LoadInt32(requests) != 3 || len(retries) != 2 {
+		t.Fatalf("got %d requests and %d retries, want 3 and 2", atomic.LoadInt32(requests), len(retries))
+	}
+	for i, retry := range retries {
+		var statusErr *StatusError
+		if retry.Attempt != i+1 || retry.URL != server.URL || !errors.As(retry.Err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("retry %d is %+v", i, retry)
+		}
+	}
+}
+
+func TestDoMaxAttempts(t *testing.T) {
+	server, requests := failingServer(t, 100, http.StatusInternalServerError, nil)
+
+	policy := testPolicy()
+	policy.MaxAttempts = 3
+	_, err := New("test", WithRetryPolicy(policy)).Do(context.Background(), server.URL)
+
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 3 || retryErr.URL != server.URL {
+		t.Fatalf("got error %v", err)
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("error %v does not wrap the status error", err)
+	}
+	if atomic.LoadInt32(requests) != 3 {
+		t.Fatalf("got %d requests, want 3", atomic.LoadInt32(requests))
+	}
+}
+
+func TestDoStatusCodeAttempts(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		want       int32
+	}{
+		{name: "not found", statusCode: http.StatusNotFound, want: 4},
+		{name: "gone", statusCode: http.StatusGone, want: 1},
+		{name: "other status codes", statusCode: http.StatusBadGateway, want: 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := failingServer(t, 100, test.statusCode, nil)
+
+			policy := testPolicy()
+			policy.MaxAttempts = 6
+			policy.StatusCodeAttempts = DefaultRetryPolicy().StatusCodeAttempts
+			_, err := New("test", WithRetryPolicy(policy)).Do(context.Background(), server.URL)
+
+			var retryErr *RetryError
+			if !errors.As(err, &retryErr) || int32(retryErr.Attempts) != test.want {
+				t.Fatalf("got error %v", err)
+			}
+			if atomic.LoadInt32(requests) != test.want {
+				t.Fatalf("got %d requests, want %d", atomic.LoadInt32(requests), test.want)
+			}
+		})
+	}
+}
+
+func TestDoMaxElapsedTime(t *testing.T) {
+	server, requests := failingServer(t, 100, http.StatusServiceUnavailable, nil)
+
+	policy := testPolicy()
+	policy.InitialBackoff = 30 * time.Millisecond
+	policy.MaxBackoff = 0
+	policy.Multiplier = 1
+	policy.MaxElapsedTime = 100 * time.Millisecond
+
+	startTime := time.Now()
+	_, err := New("test", WithRetryPolicy(policy)).Do(context.Background(), server.URL)
+
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("got error %v", err)
+	}
+	// The request gives up instead of waiting past MaxElapsedTime.
+	if elapsed := time.Since(startTime); elapsed > policy.MaxElapsedTime {
+		t.Fatalf("gave up after %v", elapsed)
+	}
+	if count := atomic.LoadInt32(requests); count < 2 || count > 4 {
+		t.Fatalf("got %d requests", count)
+	}
+}
+
+func TestDoRetryAfterCancelled(t *testing.T) {
+	server, requests := failingServer(t, 100, http.StatusTooManyRequests, http.Header{"Retry-After": {"120"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wait time.Duration
+	request := New("test", WithRetryPolicy(testPolicy()), WithOnRetry(func(retry Retry) {
+		wait = retry.Wait
+		cancel()
+	}))
+
+	startTime := time.Now()
+	_, err := request.Do(ctx, server.URL)
+
+	if wait != 120*time.Second {
+		t.Fatalf("got wait %v, want the Retry-After of 120s", wait)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v", err)
+	}
+	if elapsed := time.Since(startTime); elapsed > 5*time.Second {
+		t.Fatalf("cancelled request returned after %v", elapsed)
+	}
+	if atomic.LoadInt32(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", atomic.LoadInt32(requests))
+	}
+}
@@ -4,38 +4,86 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/grafov/m3u8"
 
 	"github.com/shaunschembri/restreamer/pkg/restream/provider"
 	"github.com/shaunschembri/restreamer/pkg/restream/provider/hls"
-	"github.com/shaunschembri/restreamer/pkg/restream/request"
 )
 
-func (r Restream) Start(ctx context.Context, playlistURL string) error {
+// Start streams playlistURL to Writer. A Restream streams a single stream, so Start is
+// called once, while Stats can be called from other goroutines while it runs.
+func (r *Restream) Start(ctx context.Context, playlistURL string) error {
+	r.statsMutex.Lock()
+	r.startTime = time.Now()
+	r.statsMutex.Unlock()
+
+	err := r.start(ctx, playlistURL)
+	if err != nil {
+		r.Observer.Error(err)
+	}
+
+	return err
+}
+
+func (r *Restream) start(ctx context.Context, playlistURL string) error {
 	if err := r.init(ctx, playlistURL); err != nil {
 		return err
 	}
 
+	if r.remuxer != nil {
+		defer r.flushRemuxer()
+	}
+
 	segmentsContext, cancel := context.WithCancel(ctx)
 	defer cancel()
 	go r.getSegments(segmentsContext)
 
+	// Live streams are stopped after MaxLiveDuration while streams with an end are
+	// always streamed to the end.
+	var liveTimeout <-chan time.Time
+	if r.MaxLiveDuration > 0 {
+		timer := time.NewTimer(r.MaxLiveDuration)
+		defer timer.Stop()
+		liveTimeout = timer.C
+	}
+
 	for {
-		segments, sleepTime, err := r.SegmentProvider.Get(ctx, r.currentBandwidth)
+		segments, sleepTime, err := r.SegmentProvider.Get(ctx, atomic.LoadUint32(&r.currentBandwidth))
+		r.Observer.PlaylistRefreshed(PlaylistEvent{Segments: segments, Reload: sleepTime, Err: err})
 		if err != nil {
 			return fmt.Errorf("failed to get new segments: %w", err)
 		}
 
+		r.setLive(!r.endOfStream())
+		r.observeVariant()
+		r.expectTracks()
+		r.segmentsQueued(segments)
 		for _, segment := range segments {
-			r.segments <- segment
+			select {
+			case r.segments <- segment:
+			case <-ctx.Done():
+				r.displayStats()
+				return nil
+			case err := <-r.errors:
+				return err
+			}
+		}
+
+		if r.endOfStream() {
+			close(r.segments)
+			return r.drain(ctx)
 		}
 
 		select {
 		case <-ctx.Done():
 			r.displayStats()
 			return nil
+		case <-liveTimeout:
+			r.displayStats()
+			return nil
 		case err := <-r.errors:
 			return err
 		case <-time.After(sleepTime):
@@ -44,29 +92,103 @@ func (r Restream) Start(ctx context.Context, playlistURL string) error {
 	}
 }
 
-func (r Restream) displayStats() {
+func (r *Restream) endOfStream() bool {
+	endOfStreamProvider, ok := r.SegmentProvider.(provider.EndOfStreamProvider)
+
+	return ok && endOfStreamProvider.EndOfStream()
+}
+
+// drain waits until the remaining segments of a stream that reached its end are written.
+func (r *Restream) drain(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+	case err := <-r.errors:
+		return err
+	case <-r.drained:
+	}
+	r.displayStats()
+
+	return nil
+}
+
+// observeVariant notifies the observer when the provider selects another variant.
+func (r *Restream) observeVariant() {
+	variantProvider, ok := r.SegmentProvider.(provider.VariantProvider)
+	if !ok {
+		return
+	}
+
+	variant := variantProvider.Variant()
+
+	r.statsMutex.Lock()
+	switched := r.currentVariant == nil || *r.currentVariant != variant
+	if switched {
+		r.currentVariant = &variant
+	}
+	r.statsMutex.Unlock()
+
+	if switched {
+		r.Observer.VariantSwitched(variant)
+	}
+}
+
+// expectTracks tells the remuxer whether the segments returned by the provider include
+// audio to be remuxed, which has to be waited for to interleave it with the video.
+func (r *Restream) expectTracks() {
+	if r.remuxer == nil || r.AudioWriter != nil {
+		return
+	}
+
+	expectAudio := false
+	if trackProvider, ok := r.SegmentProvider.(provider.TrackProvider); ok {
+		for _, track := range trackProvider.Tracks() {
+			expectAudio = expectAudio || track == provider.TrackAudio
+		}
+	}
+	r.remuxer.ExpectAudio(expectAudio)
+}
+
+func (r *Restream) flushRemuxer() {
+	if err := r.remuxer.Flush(); err != nil {
+		log.Printf("Error flushing remuxed output: %v", err)
+	}
+}
+
+func (r *Restream) displayStats() {
+	stats := r.Stats()
 	statsString := fmt.Sprintf("Streamed: %5.1fMB | Calculated Bandwidth: %4.1fMb/s",
-		float64(r.streamedBytes)/mbDivider, float64(r.currentBandwidth)/mbDivider)
+		float64(stats.BytesStreamed)/mbDivider, float64(stats.Bandwidth)/mbDivider)
 
-	if r.decrypter != nil {
-		statsString += fmt.Sprintf(" | Decrypter %s", r.decrypter.info())
+	r.statsMutex.Lock()
+	decrypterInfo := r.decrypterInfo
+	r.statsMutex.Unlock()
+	if decrypterInfo != "" {
+		statsString += fmt.Sprintf(" | Decrypter %s", decrypterInfo)
 	}
 
 	log.Printf("%s | Playlist Type: %s", statsString, r.SegmentProvider.Info())
 }
 
-func (r *Restream) detectStream(ctx context.Context, playlistURL, userAgent string, maxBandwidth uint32) (provider.Provider, error) {
-	request := request.New(userAgent)
-	playlist, err := hls.GetPlaylist(ctx, request, playlistURL)
+func (r *Restream) detectStream(ctx context.Context, playlistURL string, maxBandwidth uint32) (provider.Provider, error) {
+	playlist, err := hls.GetPlaylist(ctx, r.request, playlistURL)
 	if err != nil {
 		return nil, fmt.Errorf("cannot get playlist: %w", err)
 	}
 
 	switch playlist.Type() {
 	case m3u8.MEDIA:
-		return hls.NewMedia(request).WithPlaylistURL(playlistURL), nil
+		return hls.NewMedia(r.request).WithPlaylistURL(playlistURL), nil
 	case m3u8.MASTER:
-		return hls.NewMaster(request, maxBandwidth).WithPlaylist(playlist), nil
+		// Renditions are only fetched when their segments are written.
+		renditions := make([]provider.Track, 0, 2)
+		if r.audioWriter != nil {
+			renditions = append(renditions, provider.TrackAudio)
+		}
+		if r.subtitleWriter != nil {
+			renditions = append(renditions, provider.TrackSubtitles)
+		}
+
+		return hls.NewMaster(r.request, maxBandwidth).WithPlaylist(playlist).WithPreference(r.Variant).WithRenditions(renditions...), nil
 	default:
 		return nil, fmt.Errorf("invalid playlist list type found at %s", playlistURL)
 	}
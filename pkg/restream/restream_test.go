@@ -0,0 +1,116 @@
+package restream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/request"
+)
+
+func TestStartEndOfStream(t *testing.T) {
+	files, server := newFileServer(t, map[string]string{
+		"/media.m3u8": `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:10
+#EXTINF:10.0,
+s1.ts
+#EXTINF:10.0,
+s2.ts
+#EXTINF:10.0,
+s3.ts
+#EXT-X-ENDLIST
+`,
+		"/s1.ts": "s1",
+		"/s2.ts": "s2",
+		"/s3.ts": "s3",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The limit on live streams does not apply to a stream with an end.
+	var output bytes.Buffer
+	streamer := &Restream{Writer: &output, Concurrency: 2, MaxLiveDuration: time.Millisecond}
+	if err := streamer.Start(ctx, server.URL+"/media.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Start did not return after the last segment")
+	}
+
+	if output.String() != "s1s2s3" {
+		t.Fatalf("got output %q", output.String())
+	}
+	// The playlist is requested to detect its type and once by the provider, never reloaded.
+	if files.count("/media.m3u8") != 2 {
+		t.Fatalf("playlist of a stream with an end requested %d times", files.count("/media.m3u8"))
+	}
+}
+
+func TestStartMaxLiveDuration(t *testing.T) {
+	_, server := newFileServer(t, map[string]string{
+		"/media.m3u8": `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:10
+#EXTINF:10.0,
+s1.ts
+`,
+		"/s1.ts": "s1",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	streamer := &Restream{Writer: &bytes.Buffer{}, MaxLiveDuration: 50 * time.Millisecond}
+	if err := streamer.Start(ctx, server.URL+"/media.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("live stream not stopped after MaxLiveDuration")
+	}
+}
+
+func TestStatsSegmentFailures(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/media.m3u8":
+			io.WriteString(writer, `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:2
+#EXTINF:2.0,
+s1.ts
+#EXTINF:2.0,
+s2.ts
+#EXT-X-ENDLIST
+`)
+		case "/s1.ts":
+			// The first segment is written on its third attempt.
+			if atomic.AddInt32(&attempts, 1) < 3 {
+				http.Error(writer, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			io.WriteString(writer, "s1")
+		default:
+			http.Error(writer, "gone", http.StatusGone)
+		}
+	}))
+	defer server.Close()
+
+	policy := request.RetryPolicy{InitialBackoff: time.Millisecond, MaxAttempts: 5, StatusCodeAttempts: map[int]int{http.StatusGone: 1}}
+	streamer := &Restream{Writer: &bytes.Buffer{}, RequestOptions: []request.Option{request.WithRetryPolicy(policy)}}
+	if err := streamer.Start(context.Background(), server.URL+"/media.m3u8"); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	stats := streamer.Stats()
+	if stats.SegmentsFetched != 1 || stats.SegmentsFailed != 1 || stats.SegmentRetries != 2 {
+		t.Fatalf("got %d segments fetched, %d failed and %d retries", stats.SegmentsFetched, stats.SegmentsFailed, stats.SegmentRetries)
+	}
+}
@@ -0,0 +1,488 @@
+package restream
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/ts"
+)
+
+// sampleAES decrypts MPEG-TS segments encrypted as specified in the Apple HTTP Live
+// Streaming Sample Encryption specification, using the key and IV of AES-128.
+type sampleAES struct {
+	aes128
+	counters map[uint16]*uint8
+}
+
+func (s sampleAES) info() string {
+	return "SAMPLE-AES"
+}
+
+func (s *sampleAES) reader(source io.Reader) io.Reader {
+	return &sampleAESReader{
+		source:    source,
+		block:     s.block,
+		iv:        s.ivBytes,
+		pmtPIDs:   make(map[uint16]bool),
+		encrypted: make(map[uint16]uint8),
+		pes:       make(map[uint16]*pesBuffer),
+		counters:  s.counters,
+	}
+}
+
+var sampleAESStreamTypes = map[uint8]uint8{
+	ts.StreamTypeSampleAESH264: ts.StreamTypeH264,
+	ts.StreamTypeSampleAESADTS: ts.StreamTypeADTS,
+	ts.StreamTypeSampleAESAC3:  ts.StreamTypeAC3,
+	ts.StreamTypeSampleAESEAC3: ts.StreamTypeEAC3,
+}
+
+type pesBuffer struct {
+	packets     []byte
+	data        []byte
+	adaptations []ts.Adaptation
+}
+
+// sampleAESReader reads an MPEG-TS stream and outputs it with the encrypted elementary
+// streams decrypted. Packets of the encrypted streams are buffered until their PES packet
+// is complete, while packets of all other streams are output as they are read.
+type sampleAESReader struct {
+	source    io.Reader
+	block     cipher.Block
+	iv        []byte
+	input     []byte
+	output    bytes.Buffer
+	pmtPIDs   map[uint16]bool
+	encrypted map[uint16]uint8
+	pes       map[uint16]*pesBuffer
+	pending   []uint16
+	counters  map[uint16]*uint8
+	eof       bool
+}
+
+func (s *sampleAESReader) Read(p []byte) (int, error) {
+	for s.output.Len() == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+
+		if err := s.fill(); err != nil {
+			return 0, err
+		}
+	}
+
+	return s.output.Read(p)
+}
+
+func (s *sampleAESReader) fill() error {
+	chunk := make([]byte, decrypterBuffer)
+	n, err := s.source.Read(chunk)
+	s.input = append(s.input, chunk[:n]...)
+
+	for len(s.input) >= ts.PacketSize {
+		if s.input[0] != ts.SyncByte {
+			return fmt.Errorf("%w: lost MPEG-TS sync", ErrDecryptionFailed)
+		}
+
+		if err := s.processPacket(s.input[:ts.PacketSize]); err != nil {
+			return err
+		}
+		s.input = s.input[ts.PacketSize:]
+	}
+
+	if errors.Is(err, io.EOF) {
+		s.eof = true
+		return s.flush()
+	}
+
+	return err
+}
+
+func (s *sampleAESReader) processPacket(packet []byte) error {
+	pid := ts.PID(packet)
+
+	switch {
+	case pid == ts.PATPID:
+		s.processPAT(packet)
+	case s.pmtPIDs[pid]:
+		s.processPMT(packet)
+		return nil
+	default:
+		if _, ok := s.encrypted[pid]; ok {
+			return s.processEncrypted(pid, packet)
+		}
+	}
+
+	s.output.Write(packet)
+
+	return nil
+}
+
+func (s *sampleAESReader) processPAT(packet []byte) {
+	if !ts.PayloadUnitStart(packet) {
+		return
+	}
+
+	section, err := ts.Section(ts.Payload(packet))
+	if err != nil {
+		return
+	}
+
+	pat, err := ts.ParsePAT(section)
+	if err != nil {
+		return
+	}
+
+	for _, pid := range pat.Programs {
+		s.pmtPIDs[pid] = true
+	}
+}
+
+// processPMT records the encrypted streams and rewrites the PMT to describe them as clear
+// streams, removing the descriptors carrying the encryption information.
+func (s *sampleAESReader) processPMT(packet []byte) {
+	if !ts.PayloadUnitStart(packet) {
+		return
+	}
+
+	section, err := ts.Section(ts.Payload(packet))
+	if err != nil {
+		s.writePacket(packet)
+		return
+	}
+
+	pmt, err := ts.ParsePMT(section)
+	if err != nil {
+		s.writePacket(packet)
+		return
+	}
+
+	for i, stream := range pmt.Streams {
+		clearType, ok := sampleAESStreamTypes[stream.Type]
+		if !ok {
+			continue
+		}
+
+		s.encrypted[stream.PID] = stream.Type
+		pmt.Streams[i].Type = clearType
+		pmt.Streams[i].Descriptors = ts.FilterDescriptors(stream.Descriptors, func(tag uint8, data []byte) bool {
+			return tag != ts.DescriptorPrivateData && !(tag == ts.DescriptorRegistration && bytes.HasPrefix(data, []byte("apad")))
+		})
+	}
+
+	s.output.Write(ts.Packetize(ts.PID(packet), ts.PSIPayload(pmt.Encode()), nil, s.counter(packet)))
+}
+
+// counter returns the output continuity counter of the PID of packet, which is kept across
+// segments as rebuilt PES packets and PMTs can span a different number of packets.
+func (s *sampleAESReader) counter(packet []byte) *uint8 {
+	pid := ts.PID(packet)
+	counter, ok := s.counters[pid]
+	if !ok {
+		counter = new(uint8)
+		*counter = ts.ContinuityCounter(packet) - 1
+		s.counters[pid] = counter
+	}
+
+	return counter
+}
+
+func (s *sampleAESReader) writePacket(packet []byte) {
+	counter := s.counter(packet)
+	if ts.HasPayload(packet) {
+		*counter = (*counter + 1) & 0x0f
+	}
+	ts.SetContinuityCounter(packet, *counter)
+	s.output.Write(packet)
+}
+
+func (s *sampleAESReader) processEncrypted(pid uint16, packet []byte) error {
+	buffer, ok := s.pes[pid]
+
+	if ts.PayloadUnitStart(packet) {
+		if ok {
+			if err := s.flushPES(pid, buffer); err != nil {
+				return err
+			}
+		}
+
+		buffer = &pesBuffer{}
+		s.pes[pid] = buffer
+		s.pending = append(s.pending, pid)
+	} else if !ok {
+		// Packets of a PES packet started in a previous segment cannot be decrypted.
+		s.writePacket(packet)
+		return nil
+	}
+
+	if field := ts.AdaptationField(packet); len(field) > 0 {
+		buffer.adaptations = append(buffer.adaptations, ts.Adaptation{Offset: len(buffer.data), Field: keptAdaptationField(field)})
+	}
+	buffer.packets = append(buffer.packets, packet...)
+	buffer.data = append(buffer.data, ts.Payload(packet)...)
+
+	return nil
+}
+
+func (s *sampleAESReader) flush() error {
+	for len(s.pending) > 0 {
+		pid := s.pending[0]
+		if err := s.flushPES(pid, s.pes[pid]); err != nil {
+			return err
+		}
+	}
+
+	if len(s.input) > 0 {
+		return fmt.Errorf("%w: segment size is not a multiple of %d", ErrDecryptionFailed, ts.PacketSize)
+	}
+
+	return nil
+}
+
+func (s *sampleAESReader) flushPES(pid uint16, buffer *pesBuffer) error {
+	delete(s.pes, pid)
+	for i, pendingPID := range s.pending {
+		if pendingPID == pid {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			break
+		}
+	}
+
+	// Malformed PES packets are passed through as they are.
+	pes, err := ts.ParsePES(buffer.data)
+	if err != nil {
+		s.writePackets(buffer.packets)
+		return nil
+	}
+
+	switch s.encrypted[pid] {
+	case ts.StreamTypeSampleAESH264:
+		pes.Payload = s.decryptH264(pes.Payload)
+	case ts.StreamTypeSampleAESADTS:
+		pes.Payload, err = s.decryptFrames(pes.Payload, adtsFrameLength)
+	case ts.StreamTypeSampleAESAC3, ts.StreamTypeSampleAESEAC3:
+		pes.Payload, err = s.decryptFrames(pes.Payload, ac3FrameLength)
+	}
+	if err != nil {
+		log.Printf("Passing through PES packet of PID %d: %v", pid, err)
+		s.writePackets(buffer.packets)
+		return nil
+	}
+
+	s.output.Write(ts.PacketizeAdaptations(pid, pes.Encode(), buffer.adaptations, s.counter(buffer.packets)))
+
+	return nil
+}
+
+func (s *sampleAESReader) writePackets(packets []byte) {
+	for ; len(packets) >= ts.PacketSize; packets = packets[ts.PacketSize:] {
+		s.writePacket(packets[:ts.PacketSize])
+	}
+}
+
+// keptAdaptationField returns the flags and the PCR of an adaptation field, dropping
+// the other optional fields and the stuffing bytes.
+func keptAdaptationField(field []byte) []byte {
+	flags := field[0] & (ts.AdaptationDiscontinuity | ts.AdaptationRandomAccess | ts.AdaptationESPriority | ts.AdaptationPCR)
+	kept := []byte{flags}
+
+	if flags&ts.AdaptationPCR != 0 && len(field) >= 7 {
+		kept = append(kept, field[1:7]...)
+	} else {
+		kept[0] &^= ts.AdaptationPCR
+	}
+
+	return kept
+}
+
+// decryptH264 decrypts the H.264 NAL units of type 1 and 5 longer than 48 bytes. After
+// removing the emulation prevention bytes the first 32 bytes of such a NAL unit are clear,
+// followed by one encrypted 16-byte block for every 160 bytes. A final block that is not
+// followed by more than 16 bytes is clear.
+func (s *sampleAESReader) decryptH264(payload []byte) []byte {
+	output := make([]byte, 0, len(payload))
+
+	for _, nalUnit := range splitNALUnits(payload) {
+		if len(nalUnit.data) <= 48 || (nalUnit.data[0]&0x1f != 1 && nalUnit.data[0]&0x1f != 5) {
+			output = append(output, nalUnit.prefix...)
+			output = append(output, nalUnit.data...)
+			continue
+		}
+
+		data := removeEmulationPrevention(nalUnit.data)
+		mode := cipher.NewCBCDecrypter(s.block, s.iv)
+		for offset := 32; len(data)-offset > aes.BlockSize; offset += 160 {
+			mode.CryptBlocks(data[offset:offset+aes.BlockSize], data[offset:offset+aes.BlockSize])
+		}
+
+		output = append(output, nalUnit.prefix...)
+		output = append(output, addEmulationPrevention(data)...)
+	}
+
+	return output
+}
+
+// decryptFrames decrypts the audio frames in payload. The first 16 bytes after the
+// frame header are clear, followed by encrypted 16-byte blocks. The bytes after the last
+// complete block are clear.
+func (s *sampleAESReader) decryptFrames(payload []byte, frameLength func([]byte) (int, int)) ([]byte, error) {
+	output := append([]byte(nil), payload...)
+
+	for offset := 0; offset < len(output); {
+		length, headerLength := frameLength(output[offset:])
+		if length == 0 || offset+length > len(output) {
+			return nil, fmt.Errorf("%w: invalid audio frame", ErrDecryptionFailed)
+		}
+
+		frame := output[offset+headerLength : offset+length]
+		if len(frame) > aes.BlockSize {
+			encrypted := frame[aes.BlockSize:]
+			encrypted = encrypted[:len(encrypted)-len(encrypted)%aes.BlockSize]
+			cipher.NewCBCDecrypter(s.block, s.iv).CryptBlocks(encrypted, encrypted)
+		}
+
+		offset += length
+	}
+
+	return output, nil
+}
+
+func adtsFrameLength(data []byte) (int, int) {
+	if len(data) < 7 || data[0] != 0xff || data[1]&0xf0 != 0xf0 {
+		return 0, 0
+	}
+
+	headerLength := 7
+	if data[1]&0x01 == 0 {
+		headerLength = 9
+	}
+
+	return int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5, headerLength
+}
+
+// Frame sizes in 16-bit words of AC-3 frames indexed by frmsizecod for 48, 44.1 and 32kHz.
+var ac3FrameSizes = [38][3]int{
+	{64, 69, 96}, {64, 70, 96}, {80, 87, 120}, {80, 88, 120}, {96, 104, 144}, {96, 105, 144},
+	{112, 121, 168}, {112, 122, 168}, {128, 139, 192}, {128, 140, 192}, {160, 174, 240},
+	{160, 175, 240}, {192, 208, 288}, {192, 209, 288}, {224, 243, 336}, {224, 244, 336},
+	{256, 278, 384}, {256, 279, 384}, {320, 348, 480}, {320, 349, 480}, {384, 417, 576},
+	{384, 418, 576}, {448, 487, 672}, {448, 488, 672}, {512, 557, 768}, {512, 558, 768},
+	{640, 696, 960}, {640, 697, 960}, {768, 835, 1152}, {768, 836, 1152}, {896, 975, 1344},
+	{896, 976, 1344}, {1024, 1114, 1536}, {1024, 1115, 1536}, {1152, 1253, 1728},
+	{1152, 1254, 1728}, {1280, 1393, 1920}, {1280, 1394, 1920},
+}
+
+// ac3FrameLength returns the length of an AC-3 or E-AC-3 sync frame. The sync frame
+// header is part of the clear leader so the header length is 0.
+func ac3FrameLength(data []byte) (int, int) {
+	if len(data) < 6 || data[0] != 0x0b || data[1] != 0x77 {
+		return 0, 0
+	}
+
+	if data[5]>>3 > 10 {
+		return (int(data[2]&0x07)<<8 | int(data[3]) + 1) * 2, 0
+	}
+
+	fscod := int(data[4] >> 6)
+	frmsizecod := int(data[4] & 0x3f)
+	if fscod > 2 || frmsizecod >= len(ac3FrameSizes) {
+		return 0, 0
+	}
+
+	return ac3FrameSizes[frmsizecod][fscod] * 2, 0
+}
+
+type nalUnit struct {
+	prefix []byte
+	data   []byte
+}
+
+func splitNALUnits(payload []byte) []nalUnit {
+	units := make([]nalUnit, 0)
+
+	start, prefixStart := -1, 0
+	for i := 0; i+2 < len(payload); i++ {
+		if payload[i] != 0x00 || payload[i+1] != 0x00 || payload[i+2] != 0x01 {
+			continue
+		}
+
+		currentPrefix := i
+		if i > 0 && payload[i-1] == 0x00 {
+			currentPrefix = i - 1
+		}
+
+		if start >= 0 {
+			units = append(units, nalUnit{prefix: payload[prefixStart:start], data: payload[start:currentPrefix]})
+		} else if currentPrefix > 0 {
+			units = append(units, nalUnit{data: payload[:currentPrefix]})
+		}
+
+		prefixStart = currentPrefix
+		start = i + 3
+		i += 2
+	}
+
+	switch {
+	case start >= 0 && start < len(payload):
+		units = append(units, nalUnit{prefix: payload[prefixStart:start], data: payload[start:]})
+	case start >= 0:
+		units = append(units, nalUnit{prefix: payload[prefixStart:]})
+	case len(payload) > 0:
+		units = append(units, nalUnit{data: payload})
+	}
+
+	// Units without data, like a payload not starting with a start code, are passed
+	// through as they are by merging them in their prefix.
+	for i, unit := range units {
+		if len(unit.data) == 0 || unit.prefix == nil {
+			units[i] = nalUnit{prefix: append(append([]byte(nil), unit.prefix...), unit.data...)}
+		}
+	}
+
+	return units
+}
+
+func removeEmulationPrevention(data []byte) []byte {
+	output := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+
+		if b == 0x00 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		output = append(output, b)
+	}
+
+	return output
+}
+
+func addEmulationPrevention(data []byte) []byte {
+	output := make([]byte, 0, len(data)+len(data)/64)
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b <= 0x03 {
+			output = append(output, 0x03)
+			zeros = 0
+		}
+
+		if b == 0x00 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		output = append(output, b)
+	}
+
+	return output
+}
@@ -0,0 +1,323 @@
+package restream
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/ts"
+	"github.com/shaunschembri/restreamer/pkg/restream/ts/tstest"
+)
+
+// testStream adds to tstest.Stream packets with arbitrary adaptation fields.
+type testStream struct {
+	*tstest.Stream
+}
+
+// packet writes a packet with as much of payload as fits after the adaptation field and
+// returns the rest of payload.
+func (s testStream) packet(pid uint16, start bool, field, payload []byte) []byte {
+	packet := []byte{ts.SyncByte, byte(pid>>8) & 0x1f, byte(pid), 0x10}
+	if start {
+		packet[1] |= 0x40
+	}
+
+	counter := s.Counter(pid)
+	*counter = (*counter + 1) & 0x0f
+	packet[3] |= *counter
+
+	available := ts.PacketSize - 4
+	if field != nil {
+		available -= 1 + len(field)
+	}
+	n := len(payload)
+	if n > available {
+		n = available
+	}
+	if n < available {
+		if field == nil {
+			field = []byte{}
+			available--
+		}
+		for ; available > n; available-- {
+			if len(field) == 0 {
+				field = append(field, 0x00)
+			} else {
+				field = append(field, 0xff)
+			}
+		}
+	}
+
+	if field != nil {
+		packet[3] |= 0x20
+		packet = append(packet, byte(len(field)))
+		packet = append(packet, field...)
+	}
+	s.Data = append(s.Data, packet...)
+	s.Data = append(s.Data, payload[:n]...)
+
+	return payload[n:]
+}
+
+// pcrPacket writes a packet without payload carrying a PCR.
+func (s testStream) pcrPacket(pid uint16, pcr uint64) {
+	packet := make([]byte, ts.PacketSize)
+	copy(packet, []byte{ts.SyncByte, byte(pid>>8) & 0x1f, byte(pid), 0x20 | *s.Counter(pid), ts.PacketSize - 5})
+	copy(packet[5:], tstest.PCRField(pcr))
+	for i := 12; i < ts.PacketSize; i++ {
+		packet[i] = 0xff
+	}
+	s.Data = append(s.Data, packet...)
+}
+
+// pes writes data in packets, adding the adaptation field of fields to the packet with
+// the same index.
+func (s testStream) pes(pid uint16, data []byte, fields map[int][]byte) {
+	for i := 0; i == 0 || len(data) > 0; i++ {
+		data = s.packet(pid, i == 0, fields[i], data)
+	}
+}
+
+func randomBytes(random *rand.Rand, length int) []byte {
+	data := make([]byte, length)
+	random.Read(data)
+	for i := range data {
+		// Runs of zeros need emulation prevention bytes.
+		if i%40 == 10 {
+			data[i] = 0
+			data[i+1] = 0
+		}
+	}
+	data[len(data)-1] = 0xff
+
+	return data
+}
+
+// encryptH264 returns the clear and SAMPLE-AES encrypted Annex B byte stream of NAL units,
+// given without emulation prevention bytes.
+func encryptH264(t *testing.T, nalUnits ...[]byte) ([]byte, []byte) {
+	t.Helper()
+
+	block, err := aes.NewCipher(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clear, encrypted []byte
+	for _, nalUnit := range nalUnits {
+		clear = append(clear, 0x00, 0x00, 0x00, 0x01)
+		clear = append(clear, addEmulationPrevention(nalUnit)...)
+
+		data := append([]byte(nil), nalUnit...)
+		if nalType := data[0] & 0x1f; len(data) > 48 && (nalType == 1 || nalType == 5) {
+			mode := cipher.NewCBCEncrypter(block, testIV)
+			for offset := 32; len(data)-offset > aes.BlockSize; offset += 160 {
+				mode.CryptBlocks(data[offset:offset+aes.BlockSize], data[offset:offset+aes.BlockSize])
+			}
+		}
+		encrypted = append(encrypted, 0x00, 0x00, 0x00, 0x01)
+		encrypted = append(encrypted, addEmulationPrevention(data)...)
+	}
+
+	return clear, encrypted
+}
+
+// encryptADTS returns the clear and SAMPLE-AES encrypted ADTS frames with payloads.
+func encryptADTS(t *testing.T, payloads ...[]byte) ([]byte, []byte) {
+	t.Helper()
+
+	var clear, encrypted []byte
+	for _, payload := range payloads {
+		length := 7 + len(payload)
+		frame := []byte{0xff, 0xf1, 0x50, 0x80 | byte(length>>11), byte(length >> 3), byte(length<<5) | 0x1f, 0xfc}
+		frame = append(frame, payload...)
+		clear = append(clear, frame...)
+
+		if len(payload) > aes.BlockSize {
+			data := frame[7+aes.BlockSize:]
+			data = data[:len(data)-len(data)%aes.BlockSize]
+			copy(data, encryptBlocks(t, testKey, testIV, data))
+		}
+		encrypted = append(encrypted, frame...)
+	}
+
+	return clear, encrypted
+}
+
+func sampleAESPMT() *ts.PMT {
+	pmt := tstest.PMT(ts.PMTStream{Type: ts.StreamTypeSampleAESADTS, PID: tstest.AudioPID, Descriptors: []byte{ts.DescriptorRegistration, 4, 'a', 'p', 'a', 'd'}})
+	pmt.Streams[0] = ts.PMTStream{Type: ts.StreamTypeSampleAESH264, PID: tstest.VideoPID, Descriptors: []byte{ts.DescriptorPrivateData, 4, 'z', 'a', 'v', 'c'}}
+
+	return pmt
+}
+
+// sampleAESSegments returns two encrypted segments together with the PES packets expected
+// by PID and the PCRs of the stream.
+func sampleAESSegments(t *testing.T) ([][]byte, map[uint16][][]byte, []uint64) {
+	t.Helper()
+
+	random := rand.New(rand.NewSource(1))
+	stream := testStream{tstest.NewStream()}
+	*stream.Counter(tstest.VideoPID), *stream.Counter(tstest.AudioPID) = 9, 3
+	expected := make(map[uint16][][]byte)
+
+	// The first video PES packet carries PCRs in its first and third packets and in a
+	// packet without payload, with stuffing in the adaptation field of the second packet.
+	stream.Tables(sampleAESPMT())
+	clear, encrypted := encryptH264(t, []byte{0x09, 0xf0}, append([]byte{0x67}, randomBytes(random, 60)...),
+		append([]byte{0x65}, randomBytes(random, 900)...), append([]byte{0x41}, randomBytes(random, 48)...))
+	stream.pes(tstest.VideoPID, ts.NewPES(0xe0, 9000, encrypted).Encode(), map[int][]byte{
+		0: append(tstest.PCRField(27000000), 0xff, 0xff),
+		1: append([]byte{0x00}, bytes.Repeat([]byte{0xff}, 60)...),
+		2: tstest.PCRField(27001000),
+	})
+	stream.pcrPacket(tstest.VideoPID, 27002000)
+	expected[tstest.VideoPID] = append(expected[tstest.VideoPID], ts.NewPES(0xe0, 9000, clear).Encode())
+
+	clear, encrypted = encryptADTS(t, randomBytes(random, 10), randomBytes(random, 100), randomBytes(random, 250))
+	stream.pes(tstest.AudioPID, ts.NewPES(0xc0, 9000, encrypted).Encode(), nil)
+	expected[tstest.AudioPID] = append(expected[tstest.AudioPID], ts.NewPES(0xc0, 9000, clear).Encode())
+
+	clear, encrypted = encryptH264(t, append([]byte{0x41}, randomBytes(random, 49)...))
+	stream.pes(tstest.VideoPID, ts.NewPES(0xe0, 12000, encrypted).Encode(), nil)
+	expected[tstest.VideoPID] = append(expected[tstest.VideoPID], ts.NewPES(0xe0, 12000, clear).Encode())
+
+	first := stream.Segment()
+
+	// The second segment has an audio frame longer than its PES packet, which is passed
+	// through as it is.
+	stream.Tables(sampleAESPMT())
+	clear, encrypted = encryptH264(t, append([]byte{0x65}, randomBytes(random, 300)...))
+	stream.pes(tstest.VideoPID, ts.NewPES(0xe0, 15000, encrypted).Encode(), map[int][]byte{0: tstest.PCRField(27003000)})
+	expected[tstest.VideoPID] = append(expected[tstest.VideoPID], ts.NewPES(0xe0, 15000, clear).Encode())
+
+	_, encrypted = encryptADTS(t, randomBytes(random, 100))
+	encrypted[4] = 0xff
+	malformed := ts.NewPES(0xc0, 15000, encrypted).Encode()
+	stream.pes(tstest.AudioPID, malformed, nil)
+	expected[tstest.AudioPID] = append(expected[tstest.AudioPID], malformed)
+
+	return [][]byte{first, stream.Segment()}, expected, []uint64{27000000, 27001000, 27002000, 27003000}
+}
+
+func TestSampleAESReader(t *testing.T) {
+	segments, expected, expectedPCRs := sampleAESSegments(t)
+
+	counters := make(map[uint16]*uint8)
+	var output []byte
+	for _, segment := range segments {
+		decrypter := &sampleAES{aes128: *newTestCipher(t, testKey, testIV), counters: counters}
+		data, err := io.ReadAll(decrypter.reader(bytes.NewReader(segment)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data)%ts.PacketSize != 0 {
+			t.Fatalf("output size %d is not a multiple of %d", len(data), ts.PacketSize)
+		}
+		output = append(output, data...)
+	}
+
+	pes := make(map[uint16][][]byte)
+	lastCounters := make(map[uint16]uint8)
+	var pcrs []uint64
+	for ; len(output) > 0; output = output[ts.PacketSize:] {
+		packet := output[:ts.PacketSize]
+		pid := ts.PID(packet)
+
+		counter := ts.ContinuityCounter(packet)
+		if last, ok := lastCounters[pid]; ok {
+			want := last
+			if ts.HasPayload(packet) {
+				want = (last + 1) & 0x0f
+			}
+			if counter != want {
+				t.Fatalf("PID %d has continuity counter %d after %d", pid, counter, last)
+			}
+		}
+		lastCounters[pid] = counter
+
+		if pcr, ok := ts.PCR(packet); ok {
+			pcrs = append(pcrs, pcr)
+		}
+
+		switch pid {
+		case tstest.PMTPID:
+			section, err := ts.Section(ts.Payload(packet))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pmt, err := ts.ParsePMT(section)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, stream := range pmt.Streams {
+				if stream.Type != ts.StreamTypeH264 && stream.Type != ts.StreamTypeADTS || len(stream.Descriptors) > 0 {
+					t.Fatalf("PMT stream %+v was not rewritten", stream)
+				}
+			}
+		case tstest.VideoPID, tstest.AudioPID:
+			if ts.PayloadUnitStart(packet) {
+				pes[pid] = append(pes[pid], nil)
+			}
+			if payload := ts.Payload(packet); payload != nil {
+				pes[pid][len(pes[pid])-1] = append(pes[pid][len(pes[pid])-1], payload...)
+			}
+		}
+	}
+
+	for _, pid := range []uint16{tstest.VideoPID, tstest.AudioPID} {
+		if len(pes[pid]) != len(expected[pid]) {
+			t.Fatalf("PID %d has %d PES packets, want %d", pid, len(pes[pid]), len(expected[pid]))
+		}
+		for i := range expected[pid] {
+			if !bytes.Equal(pes[pid][i], expected[pid][i]) {
+				t.Errorf("PES packet %d of PID %d differs from the clear PES packet", i, pid)
+			}
+		}
+	}
+
+	if len(pcrs) != len(expectedPCRs) {
+		t.Fatalf("got PCRs %v, want %v", pcrs, expectedPCRs)
+	}
+	for i := range pcrs {
+		if pcrs[i] != expectedPCRs[i] {
+			t.Fatalf("got PCRs %v, want %v", pcrs, expectedPCRs)
+		}
+	}
+}
+
+func TestPacketizeAdaptations(t *testing.T) {
+	data := bytes.Repeat([]byte{0xaa}, 500)
+	counter := uint8(15)
+	packets := ts.PacketizeAdaptations(tstest.VideoPID, data, []ts.Adaptation{
+		{Offset: 0, Field: tstest.PCRField(300)},
+		{Offset: 200, Field: tstest.PCRField(600)},
+		{Offset: 200, Field: tstest.PCRField(900)},
+	}, &counter)
+
+	var payload []byte
+	var pcrs []uint64
+	for ; len(packets) > 0; packets = packets[ts.PacketSize:] {
+		packet := packets[:ts.PacketSize]
+		if pcr, ok := ts.PCR(packet); ok {
+			pcrs = append(pcrs, pcr)
+			if pcr == 900 && len(payload) != 200 {
+				t.Fatalf("PCR 900 is in the packet starting at offset %d, want 200", len(payload))
+			}
+		}
+		payload = append(payload, ts.Payload(packet)...)
+	}
+
+	if !bytes.Equal(payload, data) {
+		t.Fatal("payload differs from data")
+	}
+	if len(pcrs) != 3 || pcrs[0] != 300 || pcrs[1] != 600 || pcrs[2] != 900 {
+		t.Fatalf("got PCRs %v", pcrs)
+	}
+	if counter != 3 {
+		t.Fatalf("got continuity counter %d, want 3", counter)
+	}
+}
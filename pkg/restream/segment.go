@@ -1,116 +1,355 @@
 package restream
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net/http"
+	"sync/atomic"
 	"time"
 
-	"github.com/shaunschembri/restreamer/pkg/restream/request"
+	"github.com/shaunschembri/restreamer/pkg/restream/provider"
 )
 
 const decrypterBuffer = 32768
 
+// segmentDownload is a segment being downloaded while the segments before it are written.
+// downloadTime is set before the buffer is closed.
+type segmentDownload struct {
+	segment      provider.Segment
+	writer       io.Writer
+	key          KeyEvent
+	decrypter    decrypter
+	buffer       *segmentBuffer
+	downloadTime time.Duration
+	bytesRead    int64
+}
+
+// getSegments downloads up to Concurrency segments at a time while writeSegments writes
+// them to the output in the order they are received.
 func (r *Restream) getSegments(ctx context.Context) {
+	downloads := make(chan *segmentDownload, r.Concurrency)
+	slots := make(chan struct{}, r.Concurrency)
+	go r.writeSegments(ctx, downloads, slots)
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case segment := <-r.segments:
-			switch segment.KeyMethod {
-			case "AES-128":
-				r.decrypter = &aes128{
-					iv:         segment.IV,
-					keyURL:     segment.KeyURL,
-					bufferSize: decrypterBuffer,
-					request:    request.New(r.UserAgent),
-				}
+		case segment, ok := <-r.segments:
+			if !ok {
+				close(downloads)
+				return
+			}
+
+			writer := r.trackWriter(segment.Track)
+			if writer == nil && segment.Track != provider.TrackMain {
+				continue
+			}
 
-				if err := r.decrypter.init(ctx); err != nil {
-					r.errors <- fmt.Errorf("error initiating decrypter %s: %w", r.decrypter.info(), err)
+			// Gap segments are not downloaded but still passed on in order.
+			if !segment.Gap {
+				if err := r.updateDecrypter(ctx, segment); err != nil {
+					r.errors <- err
 					return
 				}
+			}
 
-			case "NONE":
-				r.decrypter = nil
-			default:
-				r.decrypter = nil
-				r.errors <- fmt.Errorf("key method %s is not supported", segment.KeyMethod)
+			select {
+			case <-ctx.Done():
 				return
+			case slots <- struct{}{}:
 			}
 
-			if err := r.writeSegment(ctx, segment.URL); err != nil {
-				r.errors <- err
-				return
+			download := &segmentDownload{
+				segment: segment,
+				writer:  writer,
 			}
+			if !segment.Gap {
+				download.key = r.currentKey
+				download.decrypter = r.decrypter
+				download.buffer = newSegmentBuffer(segmentBufferLimit)
+				go r.download(ctx, download)
+			}
+			downloads <- download
 		}
 	}
 }
 
-func (r *Restream) writeSegment(ctx context.Context, url string) error {
-	request := request.New(r.UserAgent)
-	response, err := request.Do(ctx, url)
-	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+// trackWriter returns the writer of track. Segments of alternate renditions are skipped
+// when no writer is set for them.
+func (r *Restream) trackWriter(track provider.Track) io.Writer {
+	switch track {
+	case provider.TrackAudio:
+		return r.audioWriter
+	case provider.TrackSubtitles:
+		return r.subtitleWriter
+	default:
+		return r.mainWriter
 	}
-	defer response.Body.Close()
+}
 
-	if r.Writer == nil {
-		return fmt.Errorf("stopping streaming as writer is nil")
-	}
+// updateDecrypter sets the decrypter of segment. Keys are fetched in the order of the
+// segments so that a key change is handled before the segments using the new key.
+func (r *Restream) updateDecrypter(ctx context.Context, segment provider.Segment) error {
+	defer r.decrypterChanged()
 
-	reader := bufio.NewReaderSize(response.Body, r.ReadBufferSize)
-	startTime := time.Now()
-	if _, err := reader.Peek(r.ReadBufferSize); err != nil {
-		if !errors.Is(err, io.EOF) {
-			return fmt.Errorf("error filling buffer: %w", err)
+	key := KeyEvent{Method: segment.KeyMethod}
+	if segment.KeyMethod != "NONE" {
+		keyURL, err := r.keyURL(segment.KeyURL)
+		if err != nil {
+			return err
 		}
+		key.URL = keyURL
 	}
-	r.currentBandwidth = uint32(float64(reader.Buffered()*8) / time.Since(startTime).Seconds())
+	r.currentKey = key
 
-	segmentSize := 0
-	writer := NewStreamWriter(ctx, r.Writer)
-	buffer := make([]byte, decrypterBuffer)
-
-	for {
-		bytesRead, readErr := io.ReadFull(reader, buffer)
-		if errors.Is(readErr, io.EOF) {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("error reading stream: %w", err)
+	switch segment.KeyMethod {
+	case "AES-128", "SAMPLE-AES":
+		cipher := aes128{
+			iv:            segment.IV,
+			mediaSequence: segment.MediaSequence,
+			keyURL:        key.URL,
+			keys:          r.KeyCache,
+			request:       r.request,
 		}
 
-		decryptedPayload, err := r.decrypt(buffer, bytesRead)
-		if err != nil {
-			return fmt.Errorf("cannot decrypt: %w", err)
+		r.decrypter = &cipher
+		if segment.KeyMethod == "SAMPLE-AES" {
+			counters, ok := r.sampleAESCounters[segment.Track]
+			if !ok {
+				counters = make(map[uint16]*uint8)
+				r.sampleAESCounters[segment.Track] = counters
+			}
+			r.decrypter = &sampleAES{aes128: cipher, counters: counters}
 		}
 
-		bytesWritten, err := writer.Write(decryptedPayload)
-		if err != nil {
-			return fmt.Errorf("error writing output: %w", err)
+		if err := r.decrypter.init(ctx); err != nil {
+			return fmt.Errorf("error initiating decrypter %s: %w", r.decrypter.info(), err)
 		}
 
-		r.streamedBytes += int64(bytesWritten)
-		segmentSize += bytesWritten
+	case "NONE":
+		r.decrypter = nil
+	default:
+		r.decrypter = nil
+		return fmt.Errorf("key method %s is not supported", segment.KeyMethod)
+	}
+
+	if segment.Map != nil && segment.KeyMethod == "SAMPLE-AES" {
+		return fmt.Errorf("SAMPLE-AES is not supported for segments with an initialization section")
 	}
 
 	return nil
 }
 
-func (r *Restream) decrypt(payload []byte, bytesRead int) ([]byte, error) {
+// download downloads a segment in its buffer. The bandwidth is estimated from the
+// download rate of the segment multiplied by the number of segments downloaded at the
+// same time, as these share the available bandwidth.
+func (r *Restream) download(ctx context.Context, download *segmentDownload) {
+	atomic.AddInt32(&r.activeDownloads, 1)
+	defer atomic.AddInt32(&r.activeDownloads, -1)
+
+	// A download waiting for the segments before it to be written is stopped with the
+	// stream.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			download.buffer.closeWithError(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	requestTime := time.Now()
+	response, err := r.get(ctx, download.segment.URL, download.segment.ByteRange)
+	if err != nil {
+		download.downloadTime = time.Since(requestTime)
+		download.buffer.closeWithError(fmt.Errorf("request failed: %w", err))
+		return
+	}
+	defer response.Body.Close()
+
+	buffer := r.readBuffers.Get().(*[]byte)
+	defer r.readBuffers.Put(buffer)
+
+	startTime := time.Now()
+	bytesRead, err := io.CopyBuffer(download.buffer, response.Body, *buffer)
+	download.downloadTime = time.Since(requestTime)
+	if err != nil {
+		download.buffer.closeWithError(fmt.Errorf("error downloading segment: %w", err))
+		return
+	}
+	download.bytesRead = bytesRead
+
+	// Segments of alternate renditions are too small to estimate the bandwidth reliably.
+	elapsed := time.Since(startTime).Seconds()
+	if elapsed > 0 && download.segment.Track == provider.TrackMain {
+		bandwidth := float64(bytesRead*8) / elapsed * float64(atomic.LoadInt32(&r.activeDownloads))
+		atomic.StoreUint32(&r.currentBandwidth, uint32(math.Min(bandwidth, math.MaxUint32)))
+	}
+
+	download.buffer.closeWithError(nil)
+}
+
+// decrypterChanged records the info of the decrypter for displayStats, which runs while the
+// decrypter is updated.
+func (r *Restream) decrypterChanged() {
+	info := ""
 	if r.decrypter != nil {
-		decryptedPayload, err := r.decrypter.decrypt(payload[:bytesRead])
-		if err != nil {
-			return nil, fmt.Errorf("[%s] %w", r.decrypter.info(), err)
+		info = r.decrypter.info()
+	}
+
+	r.statsMutex.Lock()
+	r.decrypterInfo = info
+	r.statsMutex.Unlock()
+}
+
+// segmentEnder is implemented by writers that need to know where each segment ends, like
+// the writers of the remuxer.
+type segmentEnder interface {
+	EndSegment() error
+}
+
+// writeSegments writes the downloaded segments to the output, freeing their download slot
+// once written. Key changes are reported as the segments are written rather than queued.
+func (r *Restream) writeSegments(ctx context.Context, downloads <-chan *segmentDownload, slots <-chan struct{}) {
+	writtenKey := KeyEvent{Method: "NONE"}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case download, ok := <-downloads:
+			if !ok {
+				close(r.drained)
+				return
+			}
+
+			if !download.segment.Gap && download.key != writtenKey {
+				writtenKey = download.key
+				r.Observer.KeyChanged(download.key)
+			}
+			r.startSegment(download.segment)
+
+			event := SegmentEvent{Segment: download.segment}
+			var err error
+			if !download.segment.Gap {
+				err = r.writeMap(ctx, download)
+				if err == nil {
+					event.Bytes, err = r.write(ctx, download.writer, download.buffer, download.decrypter)
+				}
+				if ender, ok := download.writer.(segmentEnder); ok && err == nil {
+					err = ender.EndSegment()
+				}
+
+				// The download is only known to be over once its buffer is read to the end.
+				if err == nil {
+					event.DownloadTime = download.downloadTime
+					event.BytesDownloaded = download.bytesRead
+				}
+			}
+			<-slots
+
+			event.Err = err
+			r.segmentWritten(download.segment, err)
+			r.Observer.SegmentFinished(event)
+
+			if err != nil {
+				r.errors <- err
+				return
+			}
 		}
+	}
+}
+
+// startSegment is called before a segment is written. A discontinuity of the main track
+// starts a new timeline in the normalizer, unless the remuxer is holding back data of the
+// previous timeline, in which case the normalizer detects the jump in the timestamps.
+func (r *Restream) startSegment(segment provider.Segment) {
+	r.Observer.SegmentStarted(segment)
 
-		return decryptedPayload, nil
+	if segment.Discontinuity && segment.Track == provider.TrackMain && r.normalizer != nil && r.remuxer == nil {
+		r.normalizer.Discontinuity()
 	}
+}
+
+// writeMap writes the media initialization section of a segment when it differs from the
+// last one written for its track, that is at the start of the stream and whenever it
+// changes, for example after switching to another variant.
+func (r *Restream) writeMap(ctx context.Context, download *segmentDownload) error {
+	segmentMap := download.segment.Map
+	currentMap := r.currentMaps[download.segment.Track]
+	if segmentMap == nil || (currentMap != nil && *currentMap == *segmentMap) {
+		return nil
+	}
+
+	response, err := r.get(ctx, segmentMap.URL, segmentMap.ByteRange)
+	if err != nil {
+		return fmt.Errorf("map request failed: %w", err)
+	}
+	defer response.Body.Close()
 
-	return payload[:bytesRead], nil
+	if _, err := r.write(ctx, download.writer, response.Body, download.decrypter); err != nil {
+		return err
+	}
+	r.currentMaps[download.segment.Track] = segmentMap
+
+	return nil
+}
+
+// get requests url, or only byteRange of it when this has a length.
+func (r *Restream) get(ctx context.Context, url string, byteRange provider.ByteRange) (*http.Response, error) {
+	if byteRange.Length == 0 {
+		return r.segmentRequest.Do(ctx, url)
+	}
+
+	return r.segmentRequest.DoRange(ctx, url, byteRange.Offset, byteRange.Length)
+}
+
+// write decrypts reader, if the segment is encrypted, and writes it to output returning the
+// number of bytes written.
+func (r *Restream) write(ctx context.Context, output io.Writer, reader io.Reader, decrypter decrypter) (int64, error) {
+	if output == nil {
+		return 0, fmt.Errorf("stopping streaming as writer is nil")
+	}
+
+	source := reader
+	if decrypter != nil {
+		source = decrypter.reader(reader)
+	}
+
+	writer := NewStreamWriter(ctx, output)
+	buffer := make([]byte, decrypterBuffer)
+	var written int64
+
+	for {
+		bytesRead, readErr := source.Read(buffer)
+		if bytesRead > 0 {
+			bytesWritten, err := writer.Write(buffer[:bytesRead])
+			written += int64(bytesWritten)
+			if err != nil {
+				return written, fmt.Errorf("error writing output: %w", err)
+			}
+
+			atomic.AddInt64(&r.streamedBytes, int64(bytesWritten))
+		}
+
+		if errors.Is(readErr, io.EOF) {
+			return written, nil
+		}
+		if readErr != nil {
+			if decrypter == nil {
+				return written, fmt.Errorf("error reading stream: %w", readErr)
+			}
+
+			if errors.Is(readErr, ErrDecryptionFailed) {
+				decrypter.invalidate()
+			}
+			return written, fmt.Errorf("error reading stream [%s]: %w", decrypter.info(), readErr)
+		}
+	}
 }
 
 type writerCtx struct {
@@ -0,0 +1,217 @@
+package restream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fileServer serves files by path, honouring Range requests, and counts the requests of
+// each path.
+type fileServer struct {
+	mutex    sync.Mutex
+	files    map[string]string
+	requests map[string]int
+}
+
+func newFileServer(t *testing.T, files map[string]string) (*fileServer, *httptest.Server) {
+	fileServer := &fileServer{files: files, requests: make(map[string]int)}
+	server := httptest.NewServer(fileServer)
+	t.Cleanup(server.Close)
+
+	return fileServer, server
+}
+
+func (f *fileServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	f.mutex.Lock()
+	f.requests[request.URL.Path]++
+	content, ok := f.files[request.URL.Path]
+	f.mutex.Unlock()
+
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	http.ServeContent(writer, request, request.URL.Path, time.Time{}, strings.NewReader(content))
+}
+
+func (f *fileServer) count(path string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.requests[path]
+}
+
+func TestWriteMap(t *testing.T) {
+	files, server := newFileServer(t, map[string]string{
+		"/media.m3u8": `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:2
+#EXT-X-MAP:URI="init1.mp4"
+#EXTINF:2.0,
+s1.m4s
+#EXTINF:2.0,
+s2.m4s
+#EXT-X-MAP:URI="init1.mp4"
+#EXTINF:2.0,
+s3.m4s
+#EXT-X-MAP:URI="init2.mp4"
+#EXTINF:2.0,
+s4.m4s
+#EXT-X-MAP:URI="init2.mp4",BYTERANGE="6@1"
+#EXTINF:2.0,
+s5.m4s
+#EXT-X-MAP:URI="init2.mp4",BYTERANGE="6@1"
+#EXTINF:2.0,
+s6.m4s
+#EXT-X-ENDLIST
+`,
+		"/init1.mp4": "[init1]",
+		"/init2.mp4": "[init2]",
+		"/s1.m4s":    "s1",
+		"/s2.m4s":    "s2",
+		"/s3.m4s":    "s3",
+		"/s4.m4s":    "s4",
+		"/s5.m4s":    "s5",
+		"/s6.m4s":    "s6",
+	})
+
+	var output bytes.Buffer
+	streamer := &Restream{Writer: &output}
+	if err := streamer.Start(context.Background(), server.URL+"/media.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The initialization section is written again only when its URI or byte range changes.
+	if want := "[init1]s1s2s3[init2]s4init2]s5s6"; output.String() != want {
+		t.Fatalf("got output %q, want %q", output.String(), want)
+	}
+	if files.count("/init1.mp4") != 1 {
+		t.Fatalf("initialization section requested %d times", files.count("/init1.mp4"))
+	}
+}
+
+func TestByteRangeSegments(t *testing.T) {
+	_, server := newFileServer(t, map[string]string{
+		"/media.m3u8": `#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:2
+#EXTINF:2.0,
+#EXT-X-BYTERANGE:3@2
+stream.ts
+#EXTINF:2.0,
+#EXT-X-BYTERANGE:4
+stream.ts
+#EXTINF:2.0,
+#EXT-X-BYTERANGE:3
+stream.ts
+#EXT-X-ENDLIST
+`,
+		"/stream.ts": "xx0123456789yy",
+	})
+
+	var output bytes.Buffer
+	streamer := &Restream{Writer: &output, Concurrency: 3}
+	if err := streamer.Start(context.Background(), server.URL+"/media.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "0123456789" {
+		t.Fatalf("got output %q", output.String())
+	}
+}
+
+const concurrentPlaylist = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:2
+#EXTINF:2.0,
+s1.ts
+#EXTINF:2.0,
+s2.ts
+#EXTINF:2.0,
+s3.ts
+#EXTINF:2.0,
+s4.ts
+#EXT-X-ENDLIST
+`
+
+func TestConcurrentSegmentsOrder(t *testing.T) {
+	thirdServed := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/media.m3u8":
+			io.WriteString(writer, concurrentPlaylist)
+		case "/s1.ts":
+			// The first segment completes after the third.
+			select {
+			case <-thirdServed:
+			case <-time.After(5 * time.Second):
+				t.Error("first segment not downloaded at the same time as the third")
+			}
+			io.WriteString(writer, "s1")
+		case "/s3.ts":
+			defer close(thirdServed)
+			io.WriteString(writer, "s3")
+		default:
+			io.WriteString(writer, strings.TrimPrefix(strings.TrimSuffix(request.URL.Path, ".ts"), "/"))
+		}
+	}))
+	defer server.Close()
+
+	var output bytes.Buffer
+	streamer := &Restream{Writer: &output, Concurrency: 3}
+	if err := streamer.Start(context.Background(), server.URL+"/media.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "s1s2s3s4" {
+		t.Fatalf("got output %q", output.String())
+	}
+}
+
+func TestConcurrentSegmentsError(t *testing.T) {
+	thirdFailed := make(chan struct{})
+	fourthStarted := make(chan struct{})
+	fourthStopped := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/media.m3u8":
+			io.WriteString(writer, concurrentPlaylist)
+		case "/s1.ts":
+			<-thirdFailed
+			io.WriteString(writer, "s1")
+		case "/s2.ts":
+			io.WriteString(writer, "s2")
+		case "/s3.ts":
+			defer close(thirdFailed)
+			<-fourthStarted
+			http.Error(writer, "gone", http.StatusGone)
+		case "/s4.ts":
+			// The download of the next segment is stopped with the stream.
+			writer.(http.Flusher).Flush()
+			close(fourthStarted)
+			<-request.Context().Done()
+			close(fourthStopped)
+		}
+	}))
+	defer server.Close()
+
+	var output bytes.Buffer
+	streamer := &Restream{Writer: &output, Concurrency: 4}
+	if err := streamer.Start(context.Background(), server.URL+"/media.m3u8"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if output.String() != "s1s2" {
+		t.Fatalf("got output %q", output.String())
+	}
+
+	select {
+	case <-fourthStopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("download of the next segment not stopped")
+	}
+}
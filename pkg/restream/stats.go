@@ -0,0 +1,107 @@
+package restream
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/shaunschembri/restreamer/pkg/restream/provider"
+	"github.com/shaunschembri/restreamer/pkg/restream/request"
+)
+
+// Stats is a snapshot of the state of a stream.
+type Stats struct {
+	StartTime       time.Time
+	Uptime          time.Duration
+	BytesStreamed   int64
+	SegmentsFetched int64
+	// SegmentsFailed counts the segments that failed after all their attempts, while
+	// SegmentRetries counts the failed attempts that were retried.
+	SegmentsFailed int64
+	SegmentRetries int64
+	// Bandwidth is the throughput measured downloading segments in bits per second.
+	Bandwidth uint32
+	// Variant is the variant selected from a master playlist, nil for media playlists.
+	Variant *provider.Variant
+	// Live is set for playlists without an end. LiveLatency is the duration of the segments
+	// listed in a live playlist that are still to be written, that is how far the output
+	// is behind the live edge.
+	Live        bool
+	LiveLatency time.Duration
+}
+
+// Stats returns a snapshot of the state of the stream. It is safe to call while the stream
+// is running.
+func (r *Restream) Stats() Stats {
+	r.statsMutex.Lock()
+	defer r.statsMutex.Unlock()
+
+	stats := Stats{
+		StartTime:       r.startTime,
+		BytesStreamed:   atomic.LoadInt64(&r.streamedBytes),
+		SegmentsFetched: r.segmentsFetched,
+		SegmentsFailed:  r.segmentsFailed,
+		SegmentRetries:  r.segmentRetries,
+		Bandwidth:       atomic.LoadUint32(&r.currentBandwidth),
+		Live:            r.live,
+	}
+	if r.live {
+		stats.LiveLatency = time.Duration(r.pendingDuration * float64(time.Second))
+	}
+	if !r.startTime.IsZero() {
+		stats.Uptime = time.Since(r.startTime)
+	}
+	if r.currentVariant != nil {
+		variant := *r.currentVariant
+		stats.Variant = &variant
+	}
+
+	return stats
+}
+
+// segmentsQueued adds the segments of the main track to the duration still to be written.
+func (r *Restream) segmentsQueued(segments []provider.Segment) {
+	r.statsMutex.Lock()
+	defer r.statsMutex.Unlock()
+
+	for _, segment := range segments {
+		if segment.Track == provider.TrackMain {
+			r.pendingDuration += segment.Duration
+		}
+	}
+}
+
+// segmentWritten updates the stats once a segment is written or fails. Gap segments are
+// not fetched.
+func (r *Restream) segmentWritten(segment provider.Segment, err error) {
+	r.statsMutex.Lock()
+	defer r.statsMutex.Unlock()
+
+	if segment.Track == provider.TrackMain {
+		r.pendingDuration -= segment.Duration
+		if r.pendingDuration < 0 {
+			r.pendingDuration = 0
+		}
+	}
+
+	switch {
+	case err != nil:
+		r.segmentsFailed++
+	case !segment.Gap:
+		r.segmentsFetched++
+	}
+}
+
+func (r *Restream) segmentRetried(retry request.Retry) {
+	r.statsMutex.Lock()
+	r.segmentRetries++
+	r.statsMutex.Unlock()
+
+	r.Observer.Retried(retry)
+}
+
+func (r *Restream) setLive(live bool) {
+	r.statsMutex.Lock()
+	defer r.statsMutex.Unlock()
+
+	r.live = live
+}
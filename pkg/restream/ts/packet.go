@@ -0,0 +1,242 @@
+package ts
+
+const (
+	PacketSize = 188
+	SyncByte   = 0x47
+	PATPID     = 0x0000
+	NullPID    = 0x1fff
+)
+
+// Adaptation field flags as defined in ISO/IEC 13818-1 section 2.4.3.4.
+const (
+	AdaptationDiscontinuity = 0x80
+	AdaptationRandomAccess  = 0x40
+	AdaptationESPriority    = 0x20
+	AdaptationPCR           = 0x10
+)
+
+func PID(packet []byte) uint16 {
+	return uint16(packet[1]&0x1f)<<8 | uint16(packet[2])
+}
+
+func PayloadUnitStart(packet []byte) bool {
+	return packet[1]&0x40 != 0
+}
+
+func HasAdaptationField(packet []byte) bool {
+	return packet[3]&0x20 != 0
+}
+
+func HasPayload(packet []byte) bool {
+	return packet[3]&0x10 != 0
+}
+
+func ContinuityCounter(packet []byte) uint8 {
+	return packet[3] & 0x0f
+}
+
+func SetContinuityCounter(packet []byte, counter uint8) {
+	packet[3] = packet[3]&0xf0 | counter&0x0f
+}
+
+// AdaptationField returns the adaptation field of the packet without its length byte or
+// nil if the packet has no adaptation field.
+func AdaptationField(packet []byte) []byte {
+	if !HasAdaptationField(packet) {
+		return nil
+	}
+
+	length := int(packet[4])
+	if 5+length > PacketSize {
+		return nil
+	}
+
+	return packet[5 : 5+length]
+}
+
+// Payload returns the payload of the packet or nil if the packet has no payload.
+func Payload(packet []byte) []byte {
+	if !HasPayload(packet) {
+		return nil
+	}
+
+	start := 4
+	if HasAdaptationField(packet) {
+		start += 1 + int(packet[4])
+	}
+	if start >= PacketSize {
+		return nil
+	}
+
+	return packet[start:PacketSize]
+}
+
+// PCR returns the program clock reference of the packet in 27MHz units.
+func PCR(packet []byte) (uint64, bool) {
+	field := AdaptationField(packet)
+	if len(field) < 7 || field[0]&AdaptationPCR == 0 {
+		return 0, false
+	}
+
+	base := uint64(field[1])<<25 | uint64(field[2])<<17 | uint64(field[3])<<9 | uint64(field[4])<<1 | uint64(field[5])>>7
+	extension := uint64(field[5]&0x01)<<8 | uint64(field[6])
+
+	return base*300 + extension, true
+}
+
+// SetPCR replaces the program clock reference of a packet already carrying one.
+func SetPCR(packet []byte, pcr uint64) {
+	field := AdaptationField(packet)
+	if len(field) < 7 || field[0]&AdaptationPCR == 0 {
+		return
+	}
+
+	base := pcr / 300 % (1 << 33)
+	extension := pcr % 300
+	field[1] = byte(base >> 25)
+	field[2] = byte(base >> 17)
+	field[3] = byte(base >> 9)
+	field[4] = byte(base >> 1)
+	field[5] = byte(base<<7) | 0x7e | byte(extension>>8)
+	field[6] = byte(extension)
+}
+
+// Adaptation is an adaptation field, without its length byte, of the packet whose payload
+// starts at Offset of the data packetized.
+type Adaptation struct {
+	Offset int
+	Field  []byte
+}
+
+// Packetize splits data, a PES packet or a PSI section including its pointer field, in
+// packets of the given PID. The optional adaptation field, without its length byte, is
+// added to the first packet. counter holds the continuity counter of the previous packet
+// of the PID and is updated with the counter of the last packet created.
+func Packetize(pid uint16, data []byte, adaptation []byte, counter *uint8) []byte {
+	var adaptations []Adaptation
+	if len(adaptation) > 0 {
+		adaptations = []Adaptation{{Field: adaptation}}
+	}
+
+	return PacketizeAdaptations(pid, data, adaptations, counter)
+}
+
+// PacketizeAdaptations is like Packetize but adds each adaptation field, sorted by offset,
+// to the packet whose payload starts at its offset. Adaptation fields sharing a packet are
+// written in packets without payload before it.
+func PacketizeAdaptations(pid uint16, data []byte, adaptations []Adaptation, counter *uint8) []byte {
+	packets := make([]byte, 0, (len(data)/(PacketSize-4)+len(adaptations)+1)*PacketSize)
+
+	offset := 0
+	for offset == 0 || offset < len(data) {
+		for len(adaptations) > 1 && adaptationOffset(adaptations[1], data) <= offset {
+			packets = append(packets, adaptationPacket(pid, adaptations[0].Field, *counter)...)
+			adaptations = adaptations[1:]
+		}
+
+		var field []byte
+		if len(adaptations) > 0 && adaptationOffset(adaptations[0], data) <= offset {
+			field = append(field, adaptations[0].Field...)
+			adaptations = adaptations[1:]
+		}
+
+		available := PacketSize - 4
+		if field != nil {
+			available -= 1 + len(field)
+		}
+		if len(adaptations) > 0 && adaptationOffset(adaptations[0], data)-offset < available {
+			available = adaptationOffset(adaptations[0], data) - offset
+		}
+		payload := data[offset:]
+		if len(payload) > available {
+			payload = payload[:available]
+		}
+
+		packet := newPacket(pid, offset == 0, field, payload, counter)
+		offset += len(payload)
+		packets = append(packets, packet...)
+
+		if len(data) == 0 {
+			break
+		}
+	}
+
+	for _, adaptation := range adaptations {
+		packets = append(packets, adaptationPacket(pid, adaptation.Field, *counter)...)
+	}
+
+	return packets
+}
+
+// adaptationOffset returns the offset of an adaptation field, those past the end of data
+// belonging to the packet carrying the last byte.
+func adaptationOffset(adaptation Adaptation, data []byte) int {
+	if adaptation.Offset >= len(data) && len(data) > 0 {
+		return len(data) - 1
+	}
+
+	return adaptation.Offset
+}
+
+// newPacket creates a packet with payload, which must fit, padded with stuffing bytes in the
+// adaptation field.
+func newPacket(pid uint16, unitStart bool, field []byte, payload []byte, counter *uint8) []byte {
+	packet := make([]byte, PacketSize)
+	packet[0] = SyncByte
+	packet[1] = byte(pid>>8) & 0x1f
+	packet[2] = byte(pid)
+	if unitStart {
+		packet[1] |= 0x40
+	}
+
+	*counter = (*counter + 1) & 0x0f
+	packet[3] = 0x10 | *counter
+
+	available := PacketSize - 4
+	if field != nil {
+		available -= 1 + len(field)
+	}
+
+	if len(payload) < available {
+		if field == nil {
+			field = make([]byte, 0, available)
+			available--
+			if available > 0 {
+				field = append(field, 0x00)
+				available--
+			}
+		}
+		for available > len(payload) {
+			field = append(field, 0xff)
+			available--
+		}
+	}
+
+	offset := 4
+	if field != nil {
+		packet[3] |= 0x20
+		packet[4] = byte(len(field))
+		copy(packet[5:], field)
+		offset += 1 + len(field)
+	}
+	copy(packet[offset:], payload)
+
+	return packet
+}
+
+// adaptationPacket creates a packet without payload carrying an adaptation field, which
+// keeps the continuity counter of the previous packet.
+func adaptationPacket(pid uint16, field []byte, counter uint8) []byte {
+	packet := make([]byte, PacketSize)
+	packet[0] = SyncByte
+	packet[1] = byte(pid>>8) & 0x1f
+	packet[2] = byte(pid)
+	packet[3] = 0x20 | counter&0x0f
+	packet[4] = PacketSize - 5
+	copy(packet[5:], field)
+	for i := 5 + len(field); i < PacketSize; i++ {
+		packet[i] = 0xff
+	}
+
+	return packet
+}
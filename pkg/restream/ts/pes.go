@@ -0,0 +1,110 @@
+package ts
+
+import (
+	"fmt"
+)
+
+// PES holds a packetized elementary stream packet split in its header, including the
+// optional header fields, and its payload.
+type PES struct {
+	Header  []byte
+	Payload []byte
+}
+
+func ParsePES(data []byte) (*PES, error) {
+	if len(data) < 9 || data[0] != 0x00 || data[1] != 0x00 || data[2] != 0x01 {
+		return nil, fmt.Errorf("invalid PES start code")
+	}
+
+	headerLength := 9 + int(data[8])
+	if headerLength > len(data) {
+		return nil, fmt.Errorf("invalid PES header length")
+	}
+
+	end := len(data)
+	if packetLength := int(data[4])<<8 | int(data[5]); packetLength != 0 && 6+packetLength < end {
+		end = 6 + packetLength
+	}
+
+	return &PES{
+		Header:  data[:headerLength],
+		Payload: data[headerLength:end],
+	}, nil
+}
+
+func (p *PES) StreamID() uint8 {
+	return p.Header[3]
+}
+
+// PTS returns the presentation timestamp in 90kHz units.
+func (p *PES) PTS() (uint64, bool) {
+	if p.Header[7]&0x80 == 0 || len(p.Header) < 14 {
+		return 0, false
+	}
+
+	return readTimestamp(p.Header[9:14]), true
+}
+
+// DTS returns the decoding timestamp in 90kHz units.
+func (p *PES) DTS() (uint64, bool) {
+	if p.Header[7]&0xc0 != 0xc0 || len(p.Header) < 19 {
+		return 0, false
+	}
+
+	return readTimestamp(p.Header[14:19]), true
+}
+
+func (p *PES) SetPTS(pts uint64) {
+	if p.Header[7]&0x80 != 0 && len(p.Header) >= 14 {
+		writeTimestamp(p.Header[9:14], p.Header[9]>>4, pts)
+	}
+}
+
+func (p *PES) SetDTS(dts uint64) {
+	if p.Header[7]&0xc0 == 0xc0 && len(p.Header) >= 19 {
+		writeTimestamp(p.Header[14:19], p.Header[14]>>4, dts)
+	}
+}
+
+// Encode returns the PES packet with the packet length updated to the payload size. The
+// packet length is left as 0, meaning unbounded, for video streams that use it.
+func (p *PES) Encode() []byte {
+	data := make([]byte, 0, len(p.Header)+len(p.Payload))
+	data = append(data, p.Header...)
+	data = append(data, p.Payload...)
+
+	packetLength := len(data) - 6
+	if (data[4] == 0 && data[5] == 0) || packetLength > 0xffff {
+		data[4], data[5] = 0, 0
+	} else {
+		data[4], data[5] = byte(packetLength>>8), byte(packetLength)
+	}
+
+	return data
+}
+
+// NewPES creates a PES packet for stream id with a PTS in 90kHz units. The packet length
+// is set unless the payload is too large for it.
+func NewPES(streamID uint8, pts uint64, payload []byte) *PES {
+	header := []byte{0x00, 0x00, 0x01, streamID, 0x00, 0x00, 0x80, 0x80, 0x05, 0, 0, 0, 0, 0}
+	writeTimestamp(header[9:14], 0x02, pts)
+	if packetLength := len(header) - 6 + len(payload); packetLength <= 0xffff {
+		header[4], header[5] = byte(packetLength>>8), byte(packetLength)
+	}
+
+	return &PES{Header: header, Payload: payload}
+}
+
+func readTimestamp(data []byte) uint64 {
+	return uint64(data[0]>>1&0x07)<<30 | uint64(data[1])<<22 | uint64(data[2]>>1)<<15 |
+		uint64(data[3])<<7 | uint64(data[4]>>1)
+}
+
+func writeTimestamp(data []byte, prefix uint8, timestamp uint64) {
+	timestamp %= 1 << 33
+	data[0] = prefix<<4 | byte(timestamp>>29)&0x0e | 0x01
+	data[1] = byte(timestamp >> 22)
+	data[2] = byte(timestamp>>14) | 0x01
+	data[3] = byte(timestamp >> 7)
+	data[4] = byte(timestamp<<1) | 0x01
+}
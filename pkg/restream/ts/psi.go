@@ -0,0 +1,236 @@
+package ts
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	TableIDPAT = 0x00
+	TableIDPMT = 0x02
+)
+
+// Stream types as defined in ISO/IEC 13818-1 table 2-34 and in the HLS Sample Encryption
+// specification.
+const (
+	StreamTypeADTS          = 0x0f
+	StreamTypeMetadata      = 0x15
+	StreamTypeH264          = 0x1b
+	StreamTypeAC3           = 0x81
+	StreamTypeEAC3          = 0x87
+	StreamTypeSampleAESAC3  = 0xc1
+	StreamTypeSampleAESEAC3 = 0xc2
+	StreamTypeSampleAESADTS = 0xcf
+	StreamTypeSampleAESH264 = 0xdb
+)
+
+// Descriptor tags as defined in ISO/IEC 13818-1 table 2-45.
+const (
+	DescriptorRegistration = 0x05
+	DescriptorPrivateData  = 0x0f
+	DescriptorMetadata     = 0x26
+)
+
+// PAT holds the program association table, mapping program numbers to PMT PIDs.
+type PAT struct {
+	TransportStreamID uint16
+	Version           uint8
+	Programs          map[uint16]uint16
+}
+
+type PMTStream struct {
+	Type        uint8
+	PID         uint16
+	Descriptors []byte
+}
+
+// PMT holds the program map table of a single program.
+type PMT struct {
+	ProgramNumber uint16
+	Version       uint8
+	PCRPID        uint16
+	ProgramInfo   []byte
+	Streams       []PMTStream
+}
+
+// Section returns the PSI section carried by the payload of a packet starting a section.
+func Section(payload []byte) ([]byte, error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("empty PSI payload")
+	}
+
+	start := 1 + int(payload[0])
+	if start+3 > len(payload) {
+		return nil, fmt.Errorf("invalid PSI pointer field")
+	}
+
+	length := int(payload[start+1]&0x0f)<<8 | int(payload[start+2])
+	end := start + 3 + length
+	if end > len(payload) {
+		return nil, fmt.Errorf("PSI section spanning multiple packets is not supported")
+	}
+
+	section := payload[start:end]
+	if CRC32(section) != 0 {
+		return nil, fmt.Errorf("invalid PSI section CRC")
+	}
+
+	return section, nil
+}
+
+func ParsePAT(section []byte) (*PAT, error) {
+	if len(section) < 12 || section[0] != TableIDPAT {
+		return nil, fmt.Errorf("invalid PAT section")
+	}
+
+	pat := &PAT{
+		TransportStreamID: uint16(section[3])<<8 | uint16(section[4]),
+		Version:           section[5] >> 1 & 0x1f,
+		Programs:          make(map[uint16]uint16),
+	}
+
+	for i := 8; i+4 <= len(section)-4; i += 4 {
+		programNumber := uint16(section[i])<<8 | uint16(section[i+1])
+		if programNumber == 0 {
+			continue
+		}
+		pat.Programs[programNumber] = uint16(section[i+2]&0x1f)<<8 | uint16(section[i+3])
+	}
+
+	return pat, nil
+}
+
+func (p *PAT) Encode() []byte {
+	section := []byte{
+		TableIDPAT, 0, 0,
+		byte(p.TransportStreamID >> 8), byte(p.TransportStreamID),
+		0xc1 | (p.Version&0x1f)<<1, 0x00, 0x00,
+	}
+
+	for _, programNumber := range sortedKeys(p.Programs) {
+		pid := p.Programs[programNumber]
+		section = append(section, byte(programNumber>>8), byte(programNumber), 0xe0|byte(pid>>8), byte(pid))
+	}
+
+	return finishSection(section)
+}
+
+func ParsePMT(section []byte) (*PMT, error) {
+	if len(section) < 16 || section[0] != TableIDPMT {
+		return nil, fmt.Errorf("invalid PMT section")
+	}
+
+	pmt := &PMT{
+		ProgramNumber: uint16(section[3])<<8 | uint16(section[4]),
+		Version:       section[5] >> 1 & 0x1f,
+		PCRPID:        uint16(section[8]&0x1f)<<8 | uint16(section[9]),
+	}
+
+	programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	offset := 12 + programInfoLength
+	end := len(section) - 4
+	if offset > end {
+		return nil, fmt.Errorf("invalid PMT program info length")
+	}
+	pmt.ProgramInfo = append([]byte(nil), section[12:offset]...)
+
+	for offset+5 <= end {
+		stream := PMTStream{
+			Type: section[offset],
+			PID:  uint16(section[offset+1]&0x1f)<<8 | uint16(section[offset+2]),
+		}
+
+		infoLength := int(section[offset+3]&0x0f)<<8 | int(section[offset+4])
+		offset += 5
+		if offset+infoLength > end {
+			return nil, fmt.Errorf("invalid PMT ES info length")
+		}
+		stream.Descriptors = append([]byte(nil), section[offset:offset+infoLength]...)
+		offset += infoLength
+
+		pmt.Streams = append(pmt.Streams, stream)
+	}
+
+	return pmt, nil
+}
+
+func (p *PMT) Encode() []byte {
+	section := []byte{
+		TableIDPMT, 0, 0,
+		byte(p.ProgramNumber >> 8), byte(p.ProgramNumber),
+		0xc1 | (p.Version&0x1f)<<1, 0x00, 0x00,
+		0xe0 | byte(p.PCRPID>>8), byte(p.PCRPID),
+		0xf0 | byte(len(p.ProgramInfo)>>8), byte(len(p.ProgramInfo)),
+	}
+	section = append(section, p.ProgramInfo...)
+
+	for _, stream := range p.Streams {
+		section = append(section,
+			stream.Type, 0xe0|byte(stream.PID>>8), byte(stream.PID),
+			0xf0|byte(len(stream.Descriptors)>>8), byte(len(stream.Descriptors)))
+		section = append(section, stream.Descriptors...)
+	}
+
+	return finishSection(section)
+}
+
+// PSIPayload prefixes a section with a zero pointer field so that it can be packetized.
+func PSIPayload(section []byte) []byte {
+	return append([]byte{0x00}, section...)
+}
+
+// FilterDescriptors calls fn for every descriptor in a descriptor loop and returns the
+// descriptors for which fn returns true.
+func FilterDescriptors(descriptors []byte, fn func(tag uint8, data []byte) bool) []byte {
+	filtered := make([]byte, 0, len(descriptors))
+	for len(descriptors) >= 2 {
+		length := int(descriptors[1])
+		if 2+length > len(descriptors) {
+			break
+		}
+
+		if fn(descriptors[0], descriptors[2:2+length]) {
+			filtered = append(filtered, descriptors[:2+length]...)
+		}
+		descriptors = descriptors[2+length:]
+	}
+
+	return filtered
+}
+
+// finishSection sets the section length and appends the CRC.
+func finishSection(section []byte) []byte {
+	length := len(section) - 3 + 4
+	section[1] = 0xb0 | byte(length>>8)&0x0f
+	section[2] = byte(length)
+
+	crc := CRC32(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func sortedKeys(programs map[uint16]uint16) []uint16 {
+	keys := make([]uint16, 0, len(programs))
+	for key := range programs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	return keys
+}
+
+// CRC32 calculates the MPEG-2 CRC of data. The CRC of a section including its CRC is 0.
+func CRC32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
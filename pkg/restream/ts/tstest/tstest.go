@@ -0,0 +1,79 @@
+// Package tstest builds MPEG-TS streams for tests.
+package tstest
+
+import (
+	"github.com/shaunschembri/restreamer/pkg/restream/ts"
+)
+
+// PIDs of the program built by Stream, with the PCR carried by the video stream.
+const (
+	PMTPID   = 0x1000
+	VideoPID = 0x100
+	AudioPID = 0x101
+)
+
+// Stream builds an MPEG-TS stream of a single program, keeping the continuity counter of
+// each PID across the segments built.
+type Stream struct {
+	Data     []byte
+	counters map[uint16]*uint8
+}
+
+func NewStream() *Stream {
+	return &Stream{counters: make(map[uint16]*uint8)}
+}
+
+// Counter returns the continuity counter of the last packet of pid, which is 15 before the
+// first packet so that the counters start from 0.
+func (s *Stream) Counter(pid uint16) *uint8 {
+	counter, ok := s.counters[pid]
+	if !ok {
+		counter = new(uint8)
+		*counter = 15
+		s.counters[pid] = counter
+	}
+
+	return counter
+}
+
+// PMT returns the PMT of an H.264 video stream followed by streams.
+func PMT(streams ...ts.PMTStream) *ts.PMT {
+	return &ts.PMT{
+		ProgramNumber: 1,
+		PCRPID:        VideoPID,
+		Streams:       append([]ts.PMTStream{{Type: ts.StreamTypeH264, PID: VideoPID}}, streams...),
+	}
+}
+
+// Tables writes a PAT pointing to PMTPID followed by pmt.
+func (s *Stream) Tables(pmt *ts.PMT) {
+	pat := &ts.PAT{TransportStreamID: 1, Programs: map[uint16]uint16{pmt.ProgramNumber: PMTPID}}
+	s.Section(ts.PATPID, pat.Encode())
+	s.Section(PMTPID, pmt.Encode())
+}
+
+func (s *Stream) Section(pid uint16, section []byte) {
+	s.Data = append(s.Data, ts.Packetize(pid, ts.PSIPayload(section), nil, s.Counter(pid))...)
+}
+
+// PES writes pes with the optional adaptation field in its first packet.
+func (s *Stream) PES(pid uint16, pes *ts.PES, adaptation []byte) {
+	s.Data = append(s.Data, ts.Packetize(pid, pes.Encode(), adaptation, s.Counter(pid))...)
+}
+
+// Segment returns the data written since the previous segment.
+func (s *Stream) Segment() []byte {
+	segment := s.Data
+	s.Data = nil
+
+	return segment
+}
+
+// PCRField returns an adaptation field, without its length byte, carrying pcr.
+func PCRField(pcr uint64) []byte {
+	packet := make([]byte, ts.PacketSize)
+	copy(packet, []byte{ts.SyncByte, 0, 0, 0x30, 7, ts.AdaptationPCR})
+	ts.SetPCR(packet, pcr)
+
+	return append([]byte(nil), ts.AdaptationField(packet)...)
+}